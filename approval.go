@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fatih/color"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// The version of the approval file format
+const approvalVersion = 1
+
+// defaultApprovalValidity is how long a request can be approved and run for,
+// unless the policy says otherwise
+const defaultApprovalValidity = 4 * time.Hour
+
+// defaultSigningKey is the key that requests and approvals are signed with,
+// unless the configuration says otherwise
+const defaultSigningKey = "~/.ssh/id_ed25519"
+
+// The namespaces of the signatures of approval files, so that the signature
+// of a request cannot pass for an approval, or be used for anything else
+const (
+	requestNamespace  = "sagacity-approval-request\n"
+	approvalNamespace = "sagacity-approval\n"
+)
+
+// ApprovalPolicy requires the destructive commands of a repository to be
+// approved, with `sp approve`, by a second person before they run
+type ApprovalPolicy struct {
+	// Keys are the SSH public keys of the people who can request and
+	// approve, in authorized_keys format
+	Keys []string `yaml:"keys"`
+
+	// ValidFor is how long a request can be approved and run for
+	ValidFor time.Duration `yaml:"valid_for,omitempty"`
+}
+
+// ApprovalRequest is what is approved: a command, as it will run, on a set of
+// hosts, by someone
+type ApprovalRequest struct {
+	Version   int       `json:"version"`
+	Item      string    `json:"item"`
+	Target    string    `json:"target"`
+	Command   string    `json:"command"`
+	Hosts     []string  `json:"hosts"`
+	Requester string    `json:"requester"`
+	Key       string    `json:"key"` // the public key of the requester
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires"`
+}
+
+// ApprovalSignature is a signature of the request of an approval file
+type ApprovalSignature struct {
+	By     string    `json:"by"`
+	Key    string    `json:"key"`
+	Time   time.Time `json:"time"`
+	Format string    `json:"format"`
+	Blob   []byte    `json:"blob"`
+}
+
+// ApprovalFile is a request signed by the requester, and the approvals of it.
+// The request is kept as it was signed, so that it verifies however it decodes.
+type ApprovalFile struct {
+	Request   json.RawMessage     `json:"request"`
+	Signature ApprovalSignature   `json:"signature"`
+	Approvals []ApprovalSignature `json:"approvals"`
+}
+
+// signed returns the data that the signatures of the file are of
+func (f *ApprovalFile) signed() []byte {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, f.Request); err != nil {
+		return f.Request
+	}
+	return buf.Bytes()
+}
+
+// validity returns how long requests are valid for under the policy
+func (p *ApprovalPolicy) validity() time.Duration {
+	if p.ValidFor <= 0 {
+		return defaultApprovalValidity
+	}
+	return p.ValidFor
+}
+
+// trusts tells if a public key is one of the keys of the policy
+func (p *ApprovalPolicy) trusts(key ssh.PublicKey) bool {
+	for _, line := range p.Keys {
+		trusted, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err == nil && bytes.Equal(trusted.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check checks that an approval file approves the one running it now, with the
+// key in want.Key, to run what is wanted, and returns who approved it
+func (p *ApprovalPolicy) Check(f *ApprovalFile, want ApprovalRequest, now time.Time) ([]string, error) {
+	req, err := f.Verify()
+	if err != nil {
+		return nil, err
+	}
+
+	requester, _, _, _, err := ssh.ParseAuthorizedKey([]byte(req.Key))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid key of the requester: %s", err)
+	}
+
+	switch {
+	case req.Key != want.Key:
+		return nil, errors.New("The request was made with another key than yours; request approval yourself")
+	case !p.trusts(requester):
+		return nil, errors.New("The request was made with a key that is not trusted to request approval")
+	case req.Item != want.Item || req.Target != want.Target:
+		return nil, fmt.Errorf("The approval is for %s %s, not %s %s", req.Item, req.Target, want.Item, want.Target)
+	case req.Command != want.Command:
+		return nil, fmt.Errorf("The approval is for the command %q, which has since changed to %q", req.Command, want.Command)
+	case strings.Join(req.Hosts, " ") != strings.Join(want.Hosts, " "):
+		return nil, fmt.Errorf("The approval is for the hosts %s, which have since changed to %s",
+			strings.Join(req.Hosts, ", "), strings.Join(want.Hosts, ", "))
+	case req.Expires.After(req.Created.Add(p.validity())):
+		return nil, fmt.Errorf("The request is valid for longer than the %s allowed", p.validity())
+	case now.After(req.Expires):
+		return nil, fmt.Errorf("The approval expired at %s", req.Expires.Local().Format("2006-01-02 15:04"))
+	}
+
+	var approvers []string
+	for _, approval := range f.Approvals {
+		key, err := approval.verify(approvalNamespace, f.signed())
+		if err != nil || approval.Key == req.Key || !p.trusts(key) {
+			continue
+		}
+		approvers = append(approvers, approval.By)
+	}
+
+	if len(approvers) == 0 {
+		return nil, errors.New("The request has not been approved by anyone allowed to approve it")
+	}
+	return approvers, nil
+}
+
+// ID identifies the approved request, so that it can be used only once
+func (f *ApprovalFile) ID() string {
+	sum := sha256.Sum256(f.signed())
+	return hex.EncodeToString(sum[:16])
+}
+
+// approvalUsed tells if a command has already run with an approval, according
+// to the history
+func approvalUsed(fn, id string) (bool, error) {
+	entries, err := ReadHistory(fn, 0)
+	if err != nil {
+		return false, err
+	}
+	for _, e := range entries {
+		if e.Approval == id && len(e.Results) != 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Verify checks the signature of the requester and returns the request
+func (f *ApprovalFile) Verify() (ApprovalRequest, error) {
+	var req ApprovalRequest
+	if err := json.Unmarshal(f.Request, &req); err != nil {
+		return req, err
+	}
+
+	if req.Version != approvalVersion {
+		return req, fmt.Errorf("Unsupported approval version %d", req.Version)
+	}
+	if f.Signature.Key != req.Key {
+		return req, errors.New("The request is not signed by its requester")
+	}
+	if _, err := f.Signature.verify(requestNamespace, f.signed()); err != nil {
+		return req, fmt.Errorf("The signature of the request is invalid: %s", err)
+	}
+	return req, nil
+}
+
+// sign signs data in a namespace with a key
+func sign(key ssh.Signer, by, namespace string, data []byte) (ApprovalSignature, error) {
+	sig, err := key.Sign(rand.Reader, append([]byte(namespace), data...))
+	if err != nil {
+		return ApprovalSignature{}, err
+	}
+
+	return ApprovalSignature{
+		By:     by,
+		Key:    authorizedKey(key.PublicKey()),
+		Time:   time.Now().UTC(),
+		Format: sig.Format,
+		Blob:   sig.Blob,
+	}, nil
+}
+
+// verify checks the signature of data in a namespace, and returns the key
+// that made it
+func (s ApprovalSignature) verify(namespace string, data []byte) (ssh.PublicKey, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s.Key))
+	if err != nil {
+		return nil, err
+	}
+
+	sig := &ssh.Signature{Format: s.Format, Blob: s.Blob}
+	if err := key.Verify(append([]byte(namespace), data...), sig); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// RequestApproval signs a request with the key of the requester and writes it
+// to a file
+func RequestApproval(fn string, req ApprovalRequest, key ssh.Signer) error {
+	req.Version = approvalVersion
+	req.Key = authorizedKey(key.PublicKey())
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	sig, err := sign(key, req.Requester, requestNamespace, data)
+	if err != nil {
+		return err
+	}
+
+	return writeApproval(fn, &ApprovalFile{Request: data, Signature: sig})
+}
+
+// ReadApproval reads an approval file
+func ReadApproval(fn string) (*ApprovalFile, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	var f ApprovalFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("%s is not an approval file: %s", fn, err)
+	}
+	return &f, nil
+}
+
+// Approve countersigns the request in an approval file with the key of the
+// approver, who cannot be the requester
+func Approve(fn string, key ssh.Signer, by string) error {
+	f, err := ReadApproval(fn)
+	if err != nil {
+		return err
+	}
+
+	req, err := f.Verify()
+	if err != nil {
+		return err
+	}
+	if time.Now().After(req.Expires) {
+		return fmt.Errorf("The request expired at %s", req.Expires.Local().Format("2006-01-02 15:04"))
+	}
+
+	pub := authorizedKey(key.PublicKey())
+	if pub == req.Key {
+		return errors.New("Requests have to be approved by someone other than the requester")
+	}
+	for _, approval := range f.Approvals {
+		if approval.Key == pub {
+			return errors.New("The request has already been approved with this key")
+		}
+	}
+
+	approval, err := sign(key, by, approvalNamespace, f.signed())
+	if err != nil {
+		return err
+	}
+	f.Approvals = append(f.Approvals, approval)
+
+	return writeApproval(fn, f)
+}
+
+// ApproveRequest shows the request in an approval file, and approves it with
+// the key in `keyfile` if the user agrees
+func ApproveRequest(repos map[string]*Repo, keyfile, fn string) error {
+	f, err := ReadApproval(fn)
+	if err != nil {
+		return err
+	}
+
+	req, err := f.Verify()
+	if err != nil {
+		return err
+	}
+	PrintApprovalRequest(req)
+
+	key, err := loadSigningKey(keyfile)
+	if err != nil {
+		return err
+	}
+
+	// Approvals from keys that the policy does not trust are not worth much
+	if item, err := ResolveRef(repos, req.Item); err == nil {
+		if c, ok := item.(*Command); ok && c.needsApproval() && !c.repo.approvalPolicy().trusts(key.PublicKey()) {
+			fmt.Println("\nYour key is not one of the keys that can approve commands of this repository.")
+		}
+	}
+
+	if !stdinIsTerminal() {
+		return errors.New("stdin is not a terminal to ask for confirmation on")
+	}
+	if !strings.HasPrefix(strings.ToLower(readAnswer("\nDo you approve? [y/N] ")), "y") {
+		return errDeclined
+	}
+
+	if err := Approve(fn, key, requesterName()); err != nil {
+		return err
+	}
+	fmt.Printf("Approved. Send %s back to %s.\n", fn, req.Requester)
+	return nil
+}
+
+// writeApproval writes an approval file
+func writeApproval(fn string, f *ApprovalFile) error {
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fn, append(data, '\n'), 0644)
+}
+
+// PrintApprovalRequest prints what a request asks to run
+func PrintApprovalRequest(req ApprovalRequest) {
+	blue := color.New(color.FgBlue, color.Bold).SprintfFunc()
+	yellow := color.New(color.FgYellow, color.Bold).SprintfFunc()
+	green := color.New(color.FgGreen, color.Bold).SprintfFunc()
+
+	fmt.Printf("%s asks to run %s, target %s:\n\n", green(req.Requester), blue(req.Item), req.Target)
+	fmt.Printf("  %s\n\non %s\n\n", yellow(req.Command), strings.Join(req.Hosts, ", "))
+	fmt.Printf("The request expires at %s.\n", req.Expires.Local().Format("2006-01-02 15:04"))
+}
+
+// loadSigningKey reads the private key that requests and approvals are
+// signed with, asking for its passphrase if it has one
+func loadSigningKey(fn string) (ssh.Signer, error) {
+	if fn == "" {
+		fn = defaultSigningKey
+	}
+
+	data, err := ioutil.ReadFile(expandHome(fn))
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(data)
+	if _, ok := err.(*ssh.PassphraseMissingError); !ok || !stdinIsTerminal() {
+		return signer, err
+	}
+
+	fmt.Printf("Passphrase for %s: ", fn)
+	passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKeyWithPassphrase(data, passphrase)
+}
+
+// needsApproval tells if the command has to be approved by a second person
+// before it runs
+func (c *Command) needsApproval() bool {
+	return c.Risk() == RiskDestructive && c.repo.approvalPolicy() != nil
+}
+
+// approvalPolicy returns the approval policy of the closest repository that
+// has one
+func (r *Repo) approvalPolicy() *ApprovalPolicy {
+	for ; r != nil; r = r.Parent {
+		if r.Approval != nil {
+			return r.Approval
+		}
+	}
+	return nil
+}
+
+// approvalRequest returns the request to approve running the command
+func (c *Command) approvalRequest(target, command string, hosts []*Host) ApprovalRequest {
+	fqdns := make([]string, len(hosts))
+	for x, host := range hosts {
+		fqdns[x] = host.FQDN
+	}
+
+	now := time.Now().UTC()
+	return ApprovalRequest{
+		Item:      c.Ref(),
+		Target:    target,
+		Command:   command,
+		Hosts:     fqdns,
+		Requester: requesterName(),
+		Created:   now,
+		Expires:   now.Add(c.repo.approvalPolicy().validity()),
+	}
+}
+
+// requestApproval writes a request to approve running the command to a file
+// in the current directory, and returns its name
+func (c *Command) requestApproval(req ApprovalRequest) (string, error) {
+	key, err := loadSigningKey(c.repo.signingKey)
+	if err != nil {
+		return "", err
+	}
+
+	fn := fmt.Sprintf(
+		"%s-%s-%s.approval.json",
+		strings.Join(strings.Fields(req.Item), "-"), req.Target, req.Created.Format("20060102-150405"),
+	)
+	return fn, RequestApproval(fn, req, key)
+}
+
+// authorizedKey returns a public key as a line of authorized_keys, without
+// a comment
+func authorizedKey(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+// requesterName returns who requests and approves, as user@host
+func requesterName() string {
+	host, _ := os.Hostname()
+	return currentUser() + "@" + host
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSigningKey writes a new private key to a file and returns its name and
+// its public key in authorized_keys format
+func testSigningKey(t *testing.T, dir, name string) (string, string) {
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fn := filepath.Join(dir, name)
+	ioutil.WriteFile(fn, pem.EncodeToMemory(block), 0600)
+
+	signer, _ := ssh.NewSignerFromKey(priv)
+	return fn, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+}
+
+func testApprovalRequest() ApprovalRequest {
+	now := time.Now().UTC()
+	return ApprovalRequest{
+		Item:      "shop ops failover",
+		Target:    "db",
+		Command:   "pg_ctl promote",
+		Hosts:     []string{"shop-db1.example.com"},
+		Requester: "alice@laptop",
+		Created:   now,
+		Expires:   now.Add(time.Hour),
+	}
+}
+
+func TestApproval(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, _ := ioutil.TempDir("", "sagacity")
+	defer os.RemoveAll(dir)
+
+	aliceKey, alicePub := testSigningKey(t, dir, "alice")
+	bobKey, bobPub := testSigningKey(t, dir, "bob")
+	eveKey, _ := testSigningKey(t, dir, "eve")
+	policy := &ApprovalPolicy{Keys: []string{alicePub, bobPub}}
+
+	alice, err := loadSigningKey(aliceKey)
+	assert.Nil(err)
+	bob, _ := loadSigningKey(bobKey)
+	eve, _ := loadSigningKey(eveKey)
+
+	fn := filepath.Join(dir, "failover.approval.json")
+	req := testApprovalRequest()
+	assert.Nil(RequestApproval(fn, req, alice))
+	req.Key = alicePub
+
+	f, err := ReadApproval(fn)
+	assert.Nil(err)
+	_, err = policy.Check(f, req, time.Now())
+	assert.EqualError(err, "The request has not been approved by anyone allowed to approve it")
+
+	// Nobody approves their own requests
+	assert.EqualError(Approve(fn, alice, "alice@laptop"), "Requests have to be approved by someone other than the requester")
+
+	// Approvals by keys that are not trusted do not count
+	assert.Nil(Approve(fn, eve, "eve@laptop"))
+	f, _ = ReadApproval(fn)
+	_, err = policy.Check(f, req, time.Now())
+	assert.NotNil(err)
+
+	assert.Nil(Approve(fn, bob, "bob@desktop"))
+	assert.EqualError(Approve(fn, bob, "bob@desktop"), "The request has already been approved with this key")
+
+	f, _ = ReadApproval(fn)
+	approvers, err := policy.Check(f, req, time.Now())
+	assert.Nil(err)
+	assert.Equal([]string{"bob@desktop"}, approvers)
+
+	_, err = policy.Check(f, req, req.Expires.Add(time.Second))
+	assert.Contains(err.Error(), "The approval expired")
+
+	changed := req
+	changed.Command = "pg_ctl stop"
+	_, err = policy.Check(f, changed, time.Now())
+	assert.Contains(err.Error(), `The approval is for the command "pg_ctl promote"`)
+
+	changed = req
+	changed.Hosts = []string{"shop-db1.example.com", "shop-db2.example.com"}
+	_, err = policy.Check(f, changed, time.Now())
+	assert.Contains(err.Error(), "The approval is for the hosts shop-db1.example.com")
+
+	changed = req
+	changed.Target = "replica"
+	_, err = policy.Check(f, changed, time.Now())
+	assert.EqualError(err, "The approval is for shop ops failover db, not shop ops failover replica")
+
+	// Only the requester can run the command with the approval
+	changed = req
+	changed.Key = bobPub
+	_, err = policy.Check(f, changed, time.Now())
+	assert.EqualError(err, "The request was made with another key than yours; request approval yourself")
+}
+
+func TestApprovalOfOwnRequestWithAnotherKey(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, _ := ioutil.TempDir("", "sagacity")
+	defer os.RemoveAll(dir)
+
+	throwawayKey, throwawayPub := testSigningKey(t, dir, "throwaway")
+	bobKey, bobPub := testSigningKey(t, dir, "bob")
+	throwaway, _ := loadSigningKey(throwawayKey)
+	bob, _ := loadSigningKey(bobKey)
+	policy := &ApprovalPolicy{Keys: []string{bobPub}}
+
+	fn := filepath.Join(dir, "failover.approval.json")
+	req := testApprovalRequest()
+	RequestApproval(fn, req, throwaway)
+	assert.Nil(Approve(fn, bob, "bob@desktop"))
+	f, _ := ReadApproval(fn)
+
+	// Bob runs it with his own key, which did not make the request
+	req.Key = bobPub
+	_, err := policy.Check(f, req, time.Now())
+	assert.EqualError(err, "The request was made with another key than yours; request approval yourself")
+
+	// Nor can he run it with the throwaway key, since it is not trusted
+	req.Key = throwawayPub
+	_, err = policy.Check(f, req, time.Now())
+	assert.EqualError(err, "The request was made with a key that is not trusted to request approval")
+}
+
+func TestApprovalValidForTooLong(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, _ := ioutil.TempDir("", "sagacity")
+	defer os.RemoveAll(dir)
+
+	aliceKey, alicePub := testSigningKey(t, dir, "alice")
+	bobKey, bobPub := testSigningKey(t, dir, "bob")
+	alice, _ := loadSigningKey(aliceKey)
+	bob, _ := loadSigningKey(bobKey)
+	policy := &ApprovalPolicy{Keys: []string{alicePub, bobPub}, ValidFor: 2 * time.Hour}
+
+	fn := filepath.Join(dir, "failover.approval.json")
+	req := testApprovalRequest()
+	req.Expires = req.Created.AddDate(100, 0, 0)
+	RequestApproval(fn, req, alice)
+	assert.Nil(Approve(fn, bob, "bob@desktop"))
+
+	f, _ := ReadApproval(fn)
+	req.Key = alicePub
+	_, err := policy.Check(f, req, time.Now())
+	assert.EqualError(err, "The request is valid for longer than the 2h0m0s allowed")
+}
+
+func TestApprovalTampering(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, _ := ioutil.TempDir("", "sagacity")
+	defer os.RemoveAll(dir)
+
+	aliceKey, alicePub := testSigningKey(t, dir, "alice")
+	bobKey, bobPub := testSigningKey(t, dir, "bob")
+	alice, _ := loadSigningKey(aliceKey)
+	bob, _ := loadSigningKey(bobKey)
+
+	fn := filepath.Join(dir, "failover.approval.json")
+	req := testApprovalRequest()
+	req.Key = alicePub
+	RequestApproval(fn, req, alice)
+	assert.Nil(Approve(fn, bob, "bob@desktop"))
+
+	data, _ := ioutil.ReadFile(fn)
+	ioutil.WriteFile(fn, []byte(strings.Replace(string(data), "pg_ctl promote", "rm -rf /", 1)), 0644)
+
+	f, err := ReadApproval(fn)
+	assert.Nil(err)
+	req.Command = "rm -rf /"
+	_, err = (&ApprovalPolicy{Keys: []string{bobPub}}).Check(f, req, time.Now())
+	assert.Contains(err.Error(), "The signature of the request is invalid")
+}
+
+func TestCommandNeedsApproval(t *testing.T) {
+	assert := assert.New(t)
+
+	// The policy is read from _repo.yaml, and applies to the subrepos
+	var shop Repo
+	assert.Nil(yaml.Unmarshal([]byte("key: shop\napproval:\n  valid_for: 30m\n"), &shop))
+	assert.Equal(30*time.Minute, shop.Approval.ValidFor)
+
+	repos := testParentRepos()
+	repos["shop"].Approval = shop.Approval
+
+	item, _ := ResolveRef(repos, "shop ops failover")
+	failover := item.(*Command)
+	assert.True(failover.needsApproval())
+
+	item, _ = ResolveRef(repos, "shop ops healthcheck")
+	assert.False(item.(*Command).needsApproval())
+
+	item, _ = ResolveRef(testParentRepos(), "shop ops failover")
+	assert.False(item.(*Command).needsApproval())
+
+	hosts, _ := failover.repo.GetHosts(failover.Hosts["db"])
+	req := failover.approvalRequest("db", "pg_ctl promote", hosts)
+	assert.Equal("shop ops failover", req.Item)
+	assert.Equal([]string{"shop-db1.example.com"}, req.Hosts)
+	assert.Equal(30*time.Minute, req.Expires.Sub(req.Created))
+}
+
+func TestApprovalIsUsedOnce(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	aliceKey, _ := testSigningKey(t, dir, "alice")
+	alice, _ := loadSigningKey(aliceKey)
+
+	fn := filepath.Join(dir, "failover.approval.json")
+	RequestApproval(fn, testApprovalRequest(), alice)
+	f, _ := ReadApproval(fn)
+
+	history := filepath.Join(dir, "history.jsonl")
+	used, err := approvalUsed(history, f.ID())
+	assert.Nil(err)
+	assert.False(used)
+
+	// Runs refused before the command ran do not use the approval
+	RecordHistory(history, HistoryEntry{Item: "shop ops failover", Approval: f.ID()})
+	used, _ = approvalUsed(history, f.ID())
+	assert.False(used)
+
+	RecordHistory(history, HistoryEntry{
+		Item:     "shop ops failover",
+		Approval: f.ID(),
+		Results:  []CommandResult{{Host: "shop-db1.example.com", Status: StatusOK}},
+	})
+	used, _ = approvalUsed(history, f.ID())
+	assert.True(used)
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The types of repositories. Git repositories are the default.
+const (
+	GitRepo     = ""
+	LocalRepo   = "local"
+	ArchiveRepo = "archive"
+)
+
+// archiveStamp is written into extracted archives to keep track of when they
+// were extracted. Being a dotfile, it is never loaded as part of the repo.
+const archiveStamp = ".sagacity-archive"
+
+// AddLocalRepo registers a directory as a repository, leaving it where it is
+func AddLocalRepo(config *Config, dir string, rc RepoConfig) error {
+	dir = absPath(dir)
+	if _, err := os.Stat(filepath.Join(dir, "_repo.yaml")); os.IsNotExist(err) {
+		return fmt.Errorf("No _repo.yaml found in %s", dir)
+	}
+
+	rc.Path = dir
+	rc.Type = LocalRepo
+	if err := config.AddRepo(rc); err != nil {
+		return err
+	}
+
+	fmt.Printf("Added %s as %s!\n", dir, rc.LoadedKey())
+	return nil
+}
+
+// AddArchiveRepo extracts a tarball or zip file, by path or URL, as a repository
+func AddArchiveRepo(config *Config, src string, rc RepoConfig) error {
+	if !isURL(src) {
+		src = absPath(src)
+	}
+	name := archiveRepoName(src)
+
+	rc.Path = filepath.Join(config.RepoRoot, rc.Namespace, name)
+	rc.Type = ArchiveRepo
+	rc.Source = src
+
+	if _, err := os.Stat(rc.Path); err == nil {
+		return fmt.Errorf("%s already exists", rc.Path)
+	}
+
+	if err := extractRepo(rc); err != nil {
+		return err
+	}
+
+	if err := config.AddRepo(rc); err != nil {
+		return err
+	}
+
+	fmt.Printf("Added %s as %s!\n", src, rc.LoadedKey())
+	return nil
+}
+
+// updateArchiveRepo extracts an archive repository again if its source has
+// changed since the last extraction. Remote sources are always extracted.
+func updateArchiveRepo(rc RepoConfig) UpdateResult {
+	if !isURL(rc.Source) {
+		src, err := os.Stat(rc.Source)
+		if err != nil {
+			return UpdateResult{Status: Failed, Detail: err.Error()}
+		}
+
+		stamp, err := os.Stat(filepath.Join(rc.Path, archiveStamp))
+		if err == nil && !src.ModTime().After(stamp.ModTime()) {
+			return UpdateResult{Status: UpToDate}
+		}
+	}
+
+	if err := extractRepo(rc); err != nil {
+		return UpdateResult{Status: Failed, Detail: err.Error()}
+	}
+
+	return UpdateResult{Status: Updated, Detail: "extracted " + rc.Source}
+}
+
+// archiveUpdated returns when an archive repository was last extracted
+func archiveUpdated(rc RepoConfig) time.Time {
+	st, err := os.Stat(filepath.Join(rc.Path, archiveStamp))
+	if err != nil {
+		return time.Time{}
+	}
+	return st.ModTime()
+}
+
+// extractRepo extracts the source of an archive repository to its path
+//
+// The archive is extracted next to the path and then moved in place, so that a
+// broken archive never leaves a half extracted repository behind.
+func extractRepo(rc RepoConfig) error {
+	src, cleanup, err := fetchArchive(rc.Source)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	os.MkdirAll(filepath.Dir(rc.Path), 0755)
+	tmp, err := ioutil.TempDir(filepath.Dir(rc.Path), "."+filepath.Base(rc.Path))
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := extractArchive(src, tmp); err != nil {
+		return err
+	}
+
+	root := tmp
+	if entries, _ := ioutil.ReadDir(tmp); len(entries) == 1 && entries[0].IsDir() {
+		root = filepath.Join(tmp, entries[0].Name())
+	}
+
+	if _, err := os.Stat(filepath.Join(root, "_repo.yaml")); os.IsNotExist(err) {
+		return fmt.Errorf("No _repo.yaml found in %s", rc.Source)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(root, archiveStamp), []byte(rc.Source+"\n"), 0644); err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(rc.Path); err != nil {
+		return err
+	}
+	return os.Rename(root, rc.Path)
+}
+
+// fetchArchive returns a local path to an archive, downloading it first if it
+// is a URL. The returned function removes any downloaded file.
+func fetchArchive(src string) (string, func(), error) {
+	if !isURL(src) {
+		return src, func() {}, nil
+	}
+
+	resp, err := http.Get(src)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("Downloading %s failed: %s", src, resp.Status)
+	}
+
+	// Keep the extension so that extractArchive knows the format.
+	f, err := ioutil.TempFile("", "sagacity-*-"+archiveName(src))
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+
+	cleanup := func() { os.Remove(f.Name()) }
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	return f.Name(), cleanup, nil
+}
+
+// extractArchive extracts a .tar, .tar.gz, .tgz or .zip file into dest
+func extractArchive(src, dest string) error {
+	switch {
+	case strings.HasSuffix(src, ".zip"):
+		return extractZip(src, dest)
+	case strings.HasSuffix(src, ".tar.gz"), strings.HasSuffix(src, ".tgz"):
+		return extractTar(src, dest, true)
+	case strings.HasSuffix(src, ".tar"):
+		return extractTar(src, dest, false)
+	}
+	return fmt.Errorf("Unknown archive format: %s", src)
+}
+
+func extractTar(src, dest string, gzipped bool) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if gzipped {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// Links and devices and the like have no business in a repository.
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = extractEntry(dest, hdr.Name, true, nil)
+		case tar.TypeReg:
+			err = extractEntry(dest, hdr.Name, false, tr)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func extractZip(src, dest string) error {
+	zr, err := zip.OpenReader(src)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			if err := extractEntry(dest, f.Name, true, nil); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !f.Mode().IsRegular() {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+
+		err = extractEntry(dest, f.Name, false, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// extractEntry writes a single file or directory of an archive into dest,
+// refusing entries that would end up outside of it
+func extractEntry(dest, name string, dir bool, r io.Reader) error {
+	path := filepath.Join(dest, name)
+	if path != dest && !strings.HasPrefix(path, dest+string(os.PathSeparator)) {
+		return fmt.Errorf("Archive entry outside of the repository: %s", name)
+	}
+
+	if dir {
+		return os.MkdirAll(path, 0755)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, r)
+	return err
+}
+
+// archiveName returns the file name of an archive path or URL
+func archiveName(src string) string {
+	if x := strings.LastIndex(src, "/"); x != -1 {
+		src = src[x+1:]
+	}
+	return src
+}
+
+// archiveRepoName derives the name of a repository from an archive path or URL
+func archiveRepoName(src string) string {
+	name := archiveName(src)
+	for _, ext := range []string{".tar.gz", ".tgz", ".tar", ".zip"} {
+		name = strings.TrimSuffix(name, ext)
+	}
+	return repoName(name)
+}
+
+func isURL(src string) bool {
+	return strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://")
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var testArchiveFiles = map[string]string{
+	"topic/_repo.yaml":       "key: topic\n",
+	"topic/note.yaml":        "type: info\nbody: archived\n",
+	"topic/sub/other.yaml":   "type: info\n",
+	"topic/not-loaded.txt":   "junk",
+	"topic/sub/another.yaml": "type: info\n",
+}
+
+// writeTestTarball writes a gzipped tarball of files into path
+func writeTestTarball(path string, files map[string]string) {
+	f, _ := os.Create(path)
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	defer gz.Close()
+	tw := tar.NewWriter(gz)
+	defer tw.Close()
+
+	for name, content := range files {
+		tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(content)),
+			Typeflag: tar.TypeReg,
+		})
+		tw.Write([]byte(content))
+	}
+}
+
+// writeTestZip writes a zip file of files into path
+func writeTestZip(path string, files map[string]string) {
+	f, _ := os.Create(path)
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	defer zw.Close()
+
+	for name, content := range files {
+		w, _ := zw.Create(name)
+		w.Write([]byte(content))
+	}
+}
+
+func testArchiveConfig(t *testing.T) (*Config, string, func()) {
+	tmp, _ := ioutil.TempDir("", "sagacity")
+	t.Setenv("SAGACITY_CACHE", filepath.Join(tmp, "items.cache"))
+	c := LoadConfig(filepath.Join(tmp, "sagacity.yaml"))
+	c.RepoRoot = filepath.Join(tmp, "repos")
+
+	return c, tmp, func() { os.RemoveAll(tmp) }
+}
+
+func TestAddArchiveRepoExtractsTarballs(t *testing.T) {
+	assert := assert.New(t)
+	c, tmp, cleanup := testArchiveConfig(t)
+	defer cleanup()
+
+	src := filepath.Join(tmp, "kb-topic.tar.gz")
+	writeTestTarball(src, testArchiveFiles)
+
+	assert.Nil(AddArchiveRepo(c, src, RepoConfig{}))
+	assert.Equal(RepoConfig{Path: filepath.Join(c.RepoRoot, "topic"), Type: ArchiveRepo, Source: src}, c.Repositories[0])
+
+	repos, err := LoadRepos(c)
+	assert.Nil(err)
+	assert.Equal(1, len(repos["topic"].Items))
+	assert.Equal(2, len(repos["topic"].Subrepos["sub"].Items))
+
+	assert.NotNil(AddArchiveRepo(c, src, RepoConfig{}))
+}
+
+func TestAddArchiveRepoRemembersAbsoluteSources(t *testing.T) {
+	assert := assert.New(t)
+	c, tmp, cleanup := testArchiveConfig(t)
+	defer cleanup()
+
+	writeTestTarball(filepath.Join(tmp, "topic.tar.gz"), testArchiveFiles)
+	t.Chdir(tmp)
+
+	assert.Nil(AddArchiveRepo(c, "topic.tar.gz", RepoConfig{}))
+	assert.Equal(filepath.Join(tmp, "topic.tar.gz"), c.Repositories[0].Source)
+}
+
+func TestAddArchiveRepoExtractsZipFiles(t *testing.T) {
+	assert := assert.New(t)
+	c, tmp, cleanup := testArchiveConfig(t)
+	defer cleanup()
+
+	src := filepath.Join(tmp, "topic.zip")
+	writeTestZip(src, map[string]string{
+		"_repo.yaml": "key: zipped\n",
+		"note.yaml":  "type: info\n",
+	})
+
+	assert.Nil(AddArchiveRepo(c, src, RepoConfig{Namespace: "team"}))
+
+	repos, err := LoadRepos(c)
+	assert.Nil(err)
+	assert.Equal(1, len(repos["team/zipped"].Items))
+}
+
+func TestAddArchiveRepoRefusesEntriesOutsideTheRepo(t *testing.T) {
+	assert := assert.New(t)
+	c, tmp, cleanup := testArchiveConfig(t)
+	defer cleanup()
+
+	src := filepath.Join(tmp, "evil.tar.gz")
+	writeTestTarball(src, map[string]string{
+		"_repo.yaml":    "",
+		"../../escaped": "gotcha",
+	})
+
+	err := AddArchiveRepo(c, src, RepoConfig{})
+
+	assert.NotNil(err)
+	assert.Equal(0, len(c.Repositories))
+	_, err = os.Stat(filepath.Join(tmp, "escaped"))
+	assert.True(os.IsNotExist(err))
+}
+
+func TestUpdateReposExtractsChangedArchives(t *testing.T) {
+	assert := assert.New(t)
+	c, tmp, cleanup := testArchiveConfig(t)
+	defer cleanup()
+
+	src := filepath.Join(tmp, "topic.tar.gz")
+	writeTestTarball(src, testArchiveFiles)
+	AddArchiveRepo(c, src, RepoConfig{})
+
+	results := UpdateRepos(c, nil, UpdateOptions{})
+	assert.Equal(UpToDate, results[0].Status)
+
+	writeTestTarball(src, map[string]string{
+		"topic/_repo.yaml": "key: topic\n",
+		"topic/new.yaml":   "type: info\n",
+	})
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(src, future, future)
+
+	results = UpdateRepos(c, nil, UpdateOptions{})
+	assert.Equal(Updated, results[0].Status)
+	assert.FileExists(filepath.Join(c.RepoRoot, "topic", "new.yaml"))
+	_, err := os.Stat(filepath.Join(c.RepoRoot, "topic", "note.yaml"))
+	assert.True(os.IsNotExist(err))
+}
+
+func TestLocalReposAreNotUpdated(t *testing.T) {
+	assert := assert.New(t)
+	c, _, cleanup := testArchiveConfig(t)
+	defer cleanup()
+
+	assert.Nil(AddLocalRepo(c, "test/repos/ref_tests/wiki", RepoConfig{}))
+	assert.NotNil(AddLocalRepo(c, "test/repos", RepoConfig{}))
+
+	results := UpdateRepos(c, nil, UpdateOptions{})
+	assert.Equal(1, len(results))
+	assert.Equal(Skipped, results[0].Status)
+}
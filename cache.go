@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+)
+
+// cacheVersion is bumped whenever the cached data changes meaning. Changes to
+// the fields of the items are caught by cacheSchema.
+const cacheVersion = 2
+
+// ItemCache keeps parsed items between runs, so that files are only parsed again
+// when their size or modification time changes
+type ItemCache struct {
+	filename string
+	entries  map[string]cacheEntry
+	used     map[string]cacheEntry
+	changed  bool
+	mu       sync.Mutex
+}
+
+// cacheEntry is a cached item along with the state of its file
+type cacheEntry struct {
+	Size    int64
+	ModTime int64
+	Item    Item
+}
+
+// cacheFile is what is stored on disk
+type cacheFile struct {
+	Version int
+	Schema  string
+	Entries map[string]cacheEntry
+}
+
+// LoadCache loads the item cache from a file. A cache that cannot be read is
+// just empty.
+func LoadCache(fn string) *ItemCache {
+	c := &ItemCache{
+		filename: fn,
+		entries:  make(map[string]cacheEntry),
+		used:     make(map[string]cacheEntry),
+	}
+
+	f, err := os.Open(fn)
+	if err != nil {
+		return c
+	}
+	defer f.Close()
+
+	var cf cacheFile
+	if err := gob.NewDecoder(f).Decode(&cf); err != nil || cf.Version != cacheVersion || cf.Schema != cacheSchema() {
+		c.changed = true
+		return c
+	}
+
+	c.entries = cf.Entries
+	return c
+}
+
+// Get returns the cached item for a file if it has not changed. Items are handed
+// out once, so that no two repositories share one.
+func (c *ItemCache) Get(r *Repo, p string, fi os.FileInfo) (Item, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[p]
+	if !ok || entry.Size != fi.Size() || entry.ModTime != fi.ModTime().UnixNano() {
+		return nil, false
+	}
+
+	entry.Item.bind(r, p)
+
+	delete(c.entries, p)
+	c.used[p] = entry
+	return entry.Item, true
+}
+
+// Put stores the item parsed from a file in the cache
+func (c *ItemCache) Put(p string, fi os.FileInfo, item Item) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.used[p] = cacheEntry{
+		Size:    fi.Size(),
+		ModTime: fi.ModTime().UnixNano(),
+		Item:    item,
+	}
+	c.changed = true
+}
+
+// Save writes the entries used since loading to disk, if anything has changed.
+// It is called once all of the repositories have been loaded.
+func (c *ItemCache) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Entries that were not handed out belong to files that are gone.
+	if !c.changed && len(c.entries) == 0 {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.filename), 0755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file that is moved in place, so that concurrent
+	// runs never see a half written cache.
+	f, err := ioutil.TempFile(filepath.Dir(c.filename), ".sagacity-cache")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	err = gob.NewEncoder(f).Encode(cacheFile{Version: cacheVersion, Schema: cacheSchema(), Entries: c.used})
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), c.filename)
+}
+
+// cacheSchema returns a fingerprint of the fields of all of the item types, since
+// gob leaves fields missing from the cache at their zero values
+func cacheSchema() string {
+	h := sha256.New()
+	seen := make(map[reflect.Type]bool)
+
+	for _, name := range ItemTypes() {
+		itemTypesMu.RLock()
+		t := itemTypes[name]
+		itemTypesMu.RUnlock()
+
+		fmt.Fprintf(h, "%s:", name)
+		writeSchema(h, reflect.TypeOf(t.New()), seen)
+	}
+
+	writeSchema(h, reflect.TypeOf(&PluginItem{}), seen)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// writeSchema writes the shape of a type, as far as gob sees it, to w
+func writeSchema(w io.Writer, t reflect.Type, seen map[reflect.Type]bool) {
+	fmt.Fprintf(w, "%s(", t)
+	defer fmt.Fprint(w, ")")
+
+	if seen[t] {
+		return
+	}
+	seen[t] = true
+
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		writeSchema(w, t.Elem(), seen)
+	case reflect.Map:
+		writeSchema(w, t.Key(), seen)
+		writeSchema(w, t.Elem(), seen)
+	case reflect.Struct:
+		for x := 0; x < t.NumField(); x++ {
+			if f := t.Field(x); f.PkgPath == "" {
+				fmt.Fprintf(w, "%s ", f.Name)
+				writeSchema(w, f.Type, seen)
+			}
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// generateRepo writes a repository of n items of all types, spread over a
+// number of subrepos
+func generateRepo(dir string, n int) {
+	os.MkdirAll(dir, 0755)
+	ioutil.WriteFile(filepath.Join(dir, "_repo.yaml"), []byte("key: generated\n"), 0644)
+
+	for x := 0; x < n; x++ {
+		sub := filepath.Join(dir, fmt.Sprintf("sub%d", x%20))
+		os.MkdirAll(sub, 0755)
+
+		var content string
+		switch x % 3 {
+		case 0:
+			content = fmt.Sprintf("type: info\nsummary: Item %d\nbody: |\n  Some text about item %d.\n  See [[generated sub0 item0]].\n", x, x)
+		case 1:
+			content = fmt.Sprintf("type: command\nsummary: Command %d\ncommand: uptime\nhosts:\n  master: hosts db master\n", x)
+		case 2:
+			content = fmt.Sprintf("type: host\nsummary: Hosts %d\ntypes:\n  master:\n    summary: Masters\n    hosts:\n      - fqdn: db%d.company.net\n        primary: true\n      - fqdn: db%d.company.net\n", x, x, x+1)
+		}
+
+		ioutil.WriteFile(filepath.Join(sub, fmt.Sprintf("item%d.yaml", x)), []byte(content), 0644)
+	}
+}
+
+func testCacheConfig(n int) (*Config, string, func()) {
+	tmp, _ := ioutil.TempDir("", "sagacity")
+	dir := filepath.Join(tmp, "generated")
+	generateRepo(dir, n)
+
+	c := &Config{
+		Repositories: []RepoConfig{{Path: dir}},
+		cache:        filepath.Join(tmp, "cache", "items.cache"),
+	}
+	return c, dir, func() { os.RemoveAll(tmp) }
+}
+
+func TestItemCacheReusesUnchangedFiles(t *testing.T) {
+	assert := assert.New(t)
+	c, dir, cleanup := testCacheConfig(9)
+	defer cleanup()
+
+	repos, _ := LoadRepos(c)
+	assert.FileExists(c.cache)
+	assert.Equal("Item 0", repos["generated"].Subrepos["sub0"].Items["item0"].Summary())
+
+	// Change the file without changing its size or modification time. If the
+	// cache is used, the change is not noticed.
+	fn := filepath.Join(dir, "sub0", "item0.yaml")
+	st, _ := os.Stat(fn)
+	data, _ := ioutil.ReadFile(fn)
+	data[len("type: info\nsummary: ")] = 'J'
+	ioutil.WriteFile(fn, data, 0644)
+	os.Chtimes(fn, st.ModTime(), st.ModTime())
+
+	repos, _ = LoadRepos(c)
+	item := repos["generated"].Subrepos["sub0"].Items["item0"].(*Info)
+	assert.Equal("Item 0", item.Summary())
+	assert.Equal("item0", item.ID())
+	assert.Equal(fn, item.Path())
+	assert.Equal(repos["generated"].Subrepos["sub0"], item.repo)
+
+	// Once the modification time changes, the file is parsed again.
+	later := st.ModTime().Add(time.Second)
+	os.Chtimes(fn, later, later)
+
+	repos, _ = LoadRepos(c)
+	assert.Equal("Jtem 0", repos["generated"].Subrepos["sub0"].Items["item0"].Summary())
+}
+
+func TestItemCacheLoadsAllTypes(t *testing.T) {
+	assert := assert.New(t)
+	c, _, cleanup := testCacheConfig(3)
+	defer cleanup()
+
+	LoadRepos(c)
+	repos, _ := LoadRepos(c)
+	sub := repos["generated"].Subrepos
+
+	assert.IsType(&Info{}, sub["sub0"].Items["item0"])
+	assert.IsType(&Command{}, sub["sub1"].Items["item1"])
+	assert.Equal("hosts db master", sub["sub1"].Items["item1"].(*Command).Hosts["master"])
+	assert.IsType(&HostInfo{}, sub["sub2"].Items["item2"])
+	assert.Equal(2, len(sub["sub2"].Items["item2"].(*HostInfo).Types["master"].Hosts))
+}
+
+func TestItemCacheIgnoresBrokenCaches(t *testing.T) {
+	assert := assert.New(t)
+	c, _, cleanup := testCacheConfig(3)
+	defer cleanup()
+
+	os.MkdirAll(filepath.Dir(c.cache), 0755)
+	ioutil.WriteFile(c.cache, []byte("garbage"), 0644)
+
+	repos, err := LoadRepos(c)
+	assert.Nil(err)
+	assert.Equal(3, len(repos["generated"].Subrepos))
+
+	cache := LoadCache(c.cache)
+	assert.Equal(4, len(cache.entries)) // The items and _repo.yaml
+}
+
+func TestItemCacheIgnoresOtherSchemas(t *testing.T) {
+	assert := assert.New(t)
+	c, _, cleanup := testCacheConfig(3)
+	defer cleanup()
+
+	LoadRepos(c)
+	assert.Equal(4, len(LoadCache(c.cache).entries))
+
+	// A cache from when the items had other fields
+	f, _ := os.Create(c.cache)
+	gob.NewEncoder(f).Encode(cacheFile{
+		Version: cacheVersion,
+		Schema:  "older",
+		Entries: LoadCache(c.cache).entries,
+	})
+	f.Close()
+	assert.Empty(LoadCache(c.cache).entries)
+
+	// Fields added to an item change the schema
+	seen := make(map[reflect.Type]bool)
+	var before, after bytes.Buffer
+	writeSchema(&before, reflect.TypeOf(struct{ Risk string }{}), seen)
+	writeSchema(&after, reflect.TypeOf(struct {
+		Risk    string
+		Windows []Window
+	}{}), seen)
+	assert.NotEqual(before.String(), after.String())
+}
+
+func benchmarkLoadRepos(b *testing.B, cached bool) {
+	c, _, cleanup := testCacheConfig(3000)
+	defer cleanup()
+
+	if !cached {
+		c.cache = ""
+	}
+
+	// Warm up the cache and the file system
+	LoadRepos(c)
+
+	b.ResetTimer()
+	for x := 0; x < b.N; x++ {
+		LoadRepos(c)
+	}
+}
+
+func BenchmarkLoadReposUncached(b *testing.B) {
+	benchmarkLoadRepos(b, false)
+}
+
+func BenchmarkLoadReposCached(b *testing.B) {
+	benchmarkLoadRepos(b, true)
+}
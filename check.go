@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/codegangsta/cli"
+	"io/ioutil"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// The phases that checks run in
+const (
+	PreCondition  = "pre"
+	PostCondition = "post"
+)
+
+// forceFlag runs a command even if its preconditions fail
+var forceFlag = cli.BoolFlag{
+	Name:  "force",
+	Usage: "run the command even if its preconditions fail",
+}
+
+// Check is a condition that is checked before or after a command runs, by
+// running a shell command or a read-only command item
+type Check struct {
+	Name    string        `yaml:"name"`
+	Run     string        `yaml:"run"`
+	Timeout time.Duration `yaml:"timeout"`
+	Expect  []Expect      `yaml:"expect"`
+
+	// Command is a command item, like `shop ops healthcheck`, run on its own hosts
+	// of the same target as the command, or of Target
+	Command string `yaml:"command"`
+	Target  string `yaml:"target"`
+}
+
+// String describes the check, by its name if it has one
+func (ch Check) String() string {
+	switch {
+	case ch.Name != "":
+		return ch.Name
+	case ch.Command != "":
+		return ch.Command
+	}
+	return ch.Run
+}
+
+// CheckResult is the outcome of a check on each of its hosts
+type CheckResult struct {
+	Check   string          `json:"check"`
+	Phase   string          `json:"phase"`
+	Results []CommandResult `json:"results,omitempty"`
+	Error   string          `json:"error,omitempty"` // when the check could not run at all
+}
+
+// Passed tells if the check passed on all of its hosts
+func (r CheckResult) Passed() bool {
+	if r.Error != "" {
+		return false
+	}
+	for _, result := range r.Results {
+		if result.Status != StatusOK {
+			return false
+		}
+	}
+	return true
+}
+
+// checksPassed tells if all of the checks passed
+func checksPassed(results []CheckResult) bool {
+	for _, r := range results {
+		if !r.Passed() {
+			return false
+		}
+	}
+	return true
+}
+
+// runChecks runs the checks of a phase of the command, run on the hosts of a
+// target
+func (c *Command) runChecks(transport Transport, phase string, checks []Check, target string, hosts []*Host) []CheckResult {
+	results := make([]CheckResult, 0, len(checks))
+	for _, check := range checks {
+		result := CheckResult{Check: check.String(), Phase: phase}
+
+		// Invalid checks, like those without anything to run, never reach
+		// the hosts
+		err := c.validateCheck(check)
+		if err == nil {
+			result.Results, err = c.runCheck(transport, check, target, hosts)
+		}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// runCheck runs a check and returns its results on each host
+func (c *Command) runCheck(transport Transport, check Check, target string, hosts []*Host) ([]CommandResult, error) {
+	if check.Command == "" {
+		inline := &Command{Timeout: check.Timeout, Expect: check.Expect, repo: c.repo}
+		command := expandVars(check.Run, c.Defaults().Vars)
+		return inline.Run(transport, hosts, command, ioutil.Discard), nil
+	}
+
+	other, otherTarget, err := c.checkCommand(check, target)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := other.repo.config.VerifyCheckout(); err != nil {
+		return nil, err
+	}
+
+	otherHosts, err := other.repo.GetHosts(other.Hosts[otherTarget])
+	if err != nil {
+		return nil, err
+	}
+
+	command := expandVars(other.RawCommand, other.Defaults().Vars)
+	return other.Run(transport, otherHosts, command, ioutil.Discard), nil
+}
+
+// checkCommand resolves the command item of a check, and the target to run it
+// on when the command is run on `target`
+func (c *Command) checkCommand(check Check, target string) (*Command, string, error) {
+	if (check.Run == "") == (check.Command == "") {
+		return nil, "", errors.New("checks need exactly one of run and command")
+	}
+
+	item, err := ResolveRef(c.repo.repos, check.Command)
+	if err != nil {
+		return nil, "", err
+	}
+
+	other, ok := item.(*Command)
+	if !ok {
+		return nil, "", fmt.Errorf("%s is not a command", check.Command)
+	}
+
+	// Checks run without confirmation, approval or maintenance windows, so
+	// they must not change anything
+	if other.Risk() != RiskReadOnly {
+		return nil, "", fmt.Errorf("%s is %s; checks can only run read-only commands", check.Command, other.Risk())
+	}
+
+	if check.Target != "" {
+		target = check.Target
+	}
+	if _, ok := other.Hosts[target]; !ok {
+		return nil, "", fmt.Errorf("%s has no host target %q", check.Command, target)
+	}
+	return other, target, nil
+}
+
+// validateCheck checks that a check can run for each of the targets of the
+// command
+func (c *Command) validateCheck(check Check) error {
+	for _, rule := range check.Expect {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if (check.Run == "") == (check.Command == "") {
+		return errors.New("checks need exactly one of run and command")
+	}
+	if check.Run != "" {
+		return nil
+	}
+
+	for _, target := range commandHostKey(c.Hosts) {
+		if _, _, err := c.checkCommand(check, target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PrintCheckResults prints a table of the results of checks and returns
+// whether all of them passed
+func PrintCheckResults(results []CheckResult) bool {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "CHECK\tHOST\tSTATUS\tDETAIL")
+	for _, r := range results {
+		if r.Error != "" {
+			fmt.Fprintf(w, "%s\t-\t%s\t%s\n", r.Check, colorStatus(StatusFailed), r.Error)
+			continue
+		}
+
+		for _, result := range r.Results {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.Check, result.Host, colorStatus(result.Status), result.Detail)
+		}
+	}
+	w.Flush()
+	return checksPassed(results)
+}
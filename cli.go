@@ -1,11 +1,16 @@
 package main
 
 import (
+	"fmt"
 	"github.com/codegangsta/cli"
+	"log"
 	"os"
-	"sort"
+	"strings"
 )
 
+// builtinCommands are the top level commands that are not repositories
+var builtinCommands = []string{"repo", "tunnels", "history", "approve"}
+
 // BuildCLI builds the base CLI App() object
 func BuildCLI(repos map[string]*Repo, conf *Config) (app *cli.App) {
 	app = cli.NewApp()
@@ -17,13 +22,7 @@ func BuildCLI(repos map[string]*Repo, conf *Config) (app *cli.App) {
 	repolen := len(repos)
 	commands := make([]cli.Command, 0, repolen+2)
 
-	keys := make([]string, 0, repolen)
-	for key := range repos {
-		keys = append(keys, key)
-	}
-
-	sort.Strings(keys)
-	for _, key := range keys {
+	for _, key := range repoKeys(repos) {
 		repo := repos[key]
 		commands = append(commands, repo.MakeCLI())
 	}
@@ -38,23 +37,260 @@ func BuildCLI(repos map[string]*Repo, conf *Config) (app *cli.App) {
 				Subcommands: []cli.Command{
 					{
 						Name:     "add",
-						Usage:    "add <url>",
+						Usage:    "add [--key <key>] [--namespace <namespace>] <url> | --path <dir> | --archive <file>",
+						HideHelp: true,
+						Flags: []cli.Flag{
+							cli.StringFlag{
+								Name:  "key",
+								Usage: "use this key instead of the one the repository declares",
+							},
+							cli.StringFlag{
+								Name:  "namespace",
+								Usage: "put the repository in a namespace, e.g. the name of a team",
+							},
+							cli.StringFlag{
+								Name:  "path",
+								Usage: "use a local directory as it is instead of cloning",
+							},
+							cli.StringFlag{
+								Name:  "archive",
+								Usage: "extract a .tar.gz or .zip file, given as a path or URL",
+							},
+						},
+						Action: func(c *cli.Context) {
+							rc := RepoConfig{
+								Key:       c.String("key"),
+								Namespace: c.String("namespace"),
+							}
+
+							var err error
+							switch {
+							case c.String("path") != "":
+								err = AddLocalRepo(conf, c.String("path"), rc)
+							case c.String("archive") != "":
+								err = AddArchiveRepo(conf, c.String("archive"), rc)
+							case len(c.Args()) == 1:
+								AddRepo(conf, c.Args()[0], rc)
+							default:
+								log.Fatal("Usage: sp repo add <url> | --path <dir> | --archive <file>")
+							}
+
+							if err != nil {
+								log.Fatal(err)
+							}
+						},
+					},
+					{
+						Name:     "list",
+						Usage:    "list",
+						HideHelp: true,
+						Action: func(c *cli.Context) {
+							ListRepos(conf, repos)
+						},
+					},
+					{
+						Name:     "status",
+						Usage:    "status",
+						HideHelp: true,
+						Action: func(c *cli.Context) {
+							PrintRepoStatus(conf, repos)
+						},
+					},
+					{
+						Name:     "remove",
+						Usage:    "remove [--delete] <key>",
 						HideHelp: true,
+						Flags: []cli.Flag{
+							cli.BoolFlag{
+								Name:  "delete",
+								Usage: "delete the clone of the repository as well",
+							},
+						},
 						Action: func(c *cli.Context) {
 							args := c.Args()
-							AddRepo(conf, args[0])
+							if len(args) != 1 {
+								log.Fatal("Usage: sp repo remove [--delete] <key>")
+							}
+
+							purge := c.Bool("delete")
+							if purge && !ask(fmt.Sprintf("Delete the clone of %s from disk? [y/N] ", args[0])) {
+								purge = false
+							}
+
+							if err := RemoveRepo(conf, repos, args[0], purge); err != nil {
+								log.Fatal(err)
+							}
+						},
+					},
+					{
+						Name:     "set-path",
+						Usage:    "set-path <key> <path>",
+						HideHelp: true,
+						Action: func(c *cli.Context) {
+							args := c.Args()
+							if len(args) != 2 {
+								log.Fatal("Usage: sp repo set-path <key> <path>")
+							}
+
+							if err := SetRepoPath(conf, repos, args[0], args[1]); err != nil {
+								log.Fatal(err)
+							}
+						},
+					},
+					{
+						Name:     "pin",
+						Usage:    "pin <key> <tag|branch|commit>",
+						HideHelp: true,
+						Action: func(c *cli.Context) {
+							args := c.Args()
+							if len(args) != 2 {
+								log.Fatal("Usage: sp repo pin <key> <tag|branch|commit>")
+							}
+
+							if err := PinRepo(conf, repos, args[0], args[1]); err != nil {
+								log.Fatal(err)
+							}
+							fmt.Printf("Pinned %s to %s. Run `sp repo update` to check it out.\n", args[0], args[1])
+						},
+					},
+					{
+						Name:     "unpin",
+						Usage:    "unpin <key>",
+						HideHelp: true,
+						Action: func(c *cli.Context) {
+							args := c.Args()
+							if len(args) != 1 {
+								log.Fatal("Usage: sp repo unpin <key>")
+							}
+
+							if err := PinRepo(conf, repos, args[0], ""); err != nil {
+								log.Fatal(err)
+							}
 						},
 					},
 					{
 						Name:     "update",
-						Usage:    "update",
+						Usage:    "update [--jobs <n>] [--allow-dirty]",
 						HideHelp: true,
+						Flags: []cli.Flag{
+							cli.IntFlag{
+								Name:  "jobs",
+								Value: 4,
+								Usage: "number of repositories to update at the same time",
+							},
+							cli.BoolFlag{
+								Name:  "allow-dirty",
+								Usage: "update repositories with local modifications",
+							},
+						},
 						Action: func(c *cli.Context) {
-							UpdateRepos(repos)
+							results := UpdateRepos(conf, repos, UpdateOptions{
+								Jobs:       c.Int("jobs"),
+								AllowDirty: c.Bool("allow-dirty"),
+							})
+
+							if !PrintUpdateResults(results) {
+								os.Exit(1)
+							}
+						},
+					},
+					{
+						Name:     "lint",
+						Usage:    "lint",
+						HideHelp: true,
+						Action: func(c *cli.Context) {
+							issues := LintRepos(repos)
+							for _, issue := range issues {
+								fmt.Println(issue)
+							}
+
+							if len(issues) != 0 {
+								os.Exit(1)
+							}
+							fmt.Println("No problems found.")
 						},
 					},
 				},
 			},
+			{
+				Name:     "tunnels",
+				Usage:    "list the running tunnels",
+				HideHelp: true,
+				Action: func(c *cli.Context) {
+					PrintTunnels(tunnelDir())
+				},
+				Subcommands: []cli.Command{
+					{
+						Name:     "stop",
+						Usage:    "stop [<name>...]",
+						HideHelp: true,
+						Action: func(c *cli.Context) {
+							if err := StopTunnels(tunnelDir(), c.Args()); err != nil {
+								log.Fatal(err)
+							}
+						},
+					},
+					{
+						Name:     "run",
+						Usage:    "run <tunnel>; what started tunnels run in the background",
+						HideHelp: true,
+						Hidden:   true,
+						Action: func(c *cli.Context) {
+							if err := RunTunnel(repos, strings.Join(c.Args(), " ")); err != nil {
+								log.Fatal(err)
+							}
+						},
+					},
+				},
+			},
+			{
+				Name:     "history",
+				Usage:    "history [--limit <n>]",
+				HideHelp: true,
+				Flags: []cli.Flag{
+					cli.IntFlag{
+						Name:  "limit",
+						Value: 20,
+						Usage: "number of runs to show, 0 for all of them",
+					},
+				},
+				Action: func(c *cli.Context) {
+					entries, err := ReadHistory(historyFilename(), c.Int("limit"))
+					if err != nil {
+						log.Fatal(err)
+					}
+					PrintHistory(entries)
+				},
+			},
+			{
+				Name:     "approve",
+				Usage:    "approve [--key <file>] <file>",
+				HideHelp: true,
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "key",
+						Usage: "the private key to approve with, instead of the signing_key of the configuration",
+					},
+				},
+				Action: func(c *cli.Context) {
+					if len(c.Args()) != 1 {
+						log.Fatal("Usage: sp approve [--key <file>] <file>")
+					}
+
+					key := c.String("key")
+					if key == "" {
+						key = conf.SigningKey
+					}
+
+					err := ApproveRequest(repos, key, c.Args()[0])
+					if err == errDeclined {
+						fmt.Println("Doing nothing.")
+						os.Exit(1)
+					} else if err != nil {
+						log.Fatal(err)
+					}
+				},
+			},
 		}...)
 	}
 
@@ -1,17 +1,32 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/codegangsta/cli"
 	"github.com/fatih/color"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"log"
 	"os"
+	"os/exec"
 	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
 )
 
+func init() {
+	RegisterItemType("command", ItemType{
+		New: func() Item { return &Command{} },
+	})
+}
+
 func commandHostKey(hosts map[string]string) []string {
 	ret := make([]string, 0, len(hosts))
-	for _, host := range hosts {
-		ret = append(ret, host)
+	for key := range hosts {
+		ret = append(ret, key)
 	}
 
 	sort.Strings(ret)
@@ -22,21 +37,80 @@ func commandHostKey(hosts map[string]string) []string {
 type Command struct {
 	RawType    string            `yaml:"type"`
 	RawSummary string            `yaml:"summary"`
+	RawAlias   string            `yaml:"alias"`
 	RawCommand string            `yaml:"command"`
 	Hosts      map[string]string `yaml:"hosts"`
-	id         string
-	path       string
-	repo       *Repo
+	SeeAlso    []string          `yaml:"see_also"`
+	Confirm    *bool             `yaml:"confirm"`
+	Vars       map[string]string `yaml:"vars"`
+
+	// RawRisk is read-only, safe, disruptive or destructive, and decides how
+	// the command is confirmed. See Command.confirm.
+	RawRisk string `yaml:"risk"`
+
+	// Timeout is how long the command may run on a host before it is
+	// terminated. There is no limit if it is not set.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// Retries is how many more times the command is run on a host that it
+	// failed or timed out on, waiting RetryDelay in between
+	Retries    int           `yaml:"retries"`
+	RetryDelay time.Duration `yaml:"retry_delay"`
+
+	// OkExitCodes are the exit codes that count as success, 0 if none are set
+	OkExitCodes []int `yaml:"ok_exit_codes"`
+
+	// Expect are rules that the output must follow. When there are any, the
+	// output is checked instead of printed.
+	Expect []Expect `yaml:"expect"`
+
+	// Preconditions must pass before the command runs, unless it is forced.
+	// Postconditions are checked after it has run.
+	Preconditions  []Check `yaml:"preconditions"`
+	Postconditions []Check `yaml:"postconditions"`
+
+	// Windows are when the command can run, instead of the windows of its
+	// repository. Freezes are added to the ones of its repositories.
+	Windows []Window `yaml:"windows"`
+	Freezes []Freeze `yaml:"freezes"`
+
+	id   string
+	path string
+	repo *Repo
+}
+
+// The statuses of a command on a host
+const (
+	StatusOK      = "ok"
+	StatusFailed  = "failed"
+	StatusTimeout = "timeout"
+	StatusRefused = "refused"
+)
+
+// CommandResult is the outcome of a command on one host
+type CommandResult struct {
+	Host     string `json:"host"`
+	Status   string `json:"status"`
+	Attempts int    `json:"attempts"`
+	Detail   string `json:"detail"`
 }
 
+// retrySleep waits between the attempts of a command
+var retrySleep = time.Sleep
+
 // MakeCLI creates the CLI tree for a Command info
 func (c Command) MakeCLI() []cli.Command {
 	sc := make([]cli.Command, 0, len(c.Hosts))
 	for _, key := range commandHostKey(c.Hosts) {
+		key := key
 		cc := cli.Command{
 			Name:     key,
+			Usage:    c.Hosts[key],
 			HideHelp: true,
-			Action:   c.Execute,
+			Flags:    c.Flags(),
+			Action: func(cl *cli.Context) {
+				c.run(key, runOptionsFrom(cl))
+			},
 		}
 		sc = append(sc, cc)
 	}
@@ -48,8 +122,6 @@ func (c Command) MakeCLI() []cli.Command {
 // If the `host` attribute is set, the command will be executed on the host(s)
 // specified.
 func (c *Command) Execute(cl *cli.Context) {
-	blue := color.New(color.FgBlue, color.Bold).SprintfFunc()
-	magenta := color.New(color.FgMagenta, color.Bold).SprintfFunc()
 	yellow := color.New(color.FgYellow, color.Bold).SprintfFunc()
 	green := color.New(color.FgGreen, color.Bold).SprintfFunc()
 
@@ -65,30 +137,324 @@ func (c *Command) Execute(cl *cli.Context) {
 				),
 			)
 		}
+		printSeeAlso(c.repo.repos, c.SeeAlso)
 		return
 	}
 
-	hostdef := c.Hosts[args[0]]
+	c.run(args[0], runOptionsFrom(cl))
+}
+
+// Flags returns the flags of the command of the item
+func (c Command) Flags() []cli.Flag {
+	return []cli.Flag{forceFlag, yesFlag, approvalFlag, overrideFlag}
+}
+
+// runOptions are the flags that a command is run with
+type runOptions struct {
+	force    bool   // run even if the preconditions fail
+	yes      bool   // do not ask, if the risk of the command allows it
+	approval string // the approval file, for commands that need approval
+	override string // why to run outside of the maintenance windows
+}
+
+// runOptionsFrom reads the run options from the flags, given either to the
+// item or to the target
+func runOptionsFrom(cl *cli.Context) runOptions {
+	opts := runOptions{
+		force: cl.Bool("force") || cl.GlobalBool("force"),
+		yes:   cl.Bool("yes") || cl.GlobalBool("yes"),
+	}
+
+	opts.approval = cl.String("approval")
+	if opts.approval == "" {
+		opts.approval = cl.GlobalString("approval")
+	}
+	opts.override = cl.String("override")
+	if opts.override == "" {
+		opts.override = cl.GlobalString("override")
+	}
+	return opts
+}
+
+// run runs the command on the host target with the given key
+func (c *Command) run(target string, opts runOptions) {
+	blue := color.New(color.FgBlue, color.Bold).SprintfFunc()
+	magenta := color.New(color.FgMagenta, color.Bold).SprintfFunc()
+	yellow := color.New(color.FgYellow, color.Bold).SprintfFunc()
+	green := color.New(color.FgGreen, color.Bold).SprintfFunc()
+
+	hostdef, ok := c.Hosts[target]
+	if !ok {
+		log.Fatalf("No such host target: %s", target)
+	}
+
+	if err := c.repo.config.VerifyCheckout(); err != nil {
+		log.Fatal("Refusing to run a command from an unverified repository: ", err)
+	}
+
+	// Resolve the hosts before asking, so that typos are caught early.
+	hosts, err := c.repo.GetHosts(hostdef)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	defaults := c.Defaults()
+	command := expandVars(c.RawCommand, defaults.Vars)
 
 	fmt.Println(
-		fmt.Sprintf("%s: %s\nRuns %s on hosts matching %s\n",
+		fmt.Sprintf("%s: %s\nRuns %s on %d hosts matching %s (%s)\n",
 			blue(c.ID()),
 			magenta(c.Summary()),
-			yellow(c.RawCommand),
+			yellow(command),
+			len(hosts),
 			green(hostdef),
+			c.Risk(),
 		),
 	)
 
-	if !ask("Do you want to continue? [y/N] ") {
+	transport := c.repo.Transport()
+	defer transport.Close()
+
+	entry := HistoryEntry{
+		Time:    time.Now(),
+		User:    currentUser(),
+		Item:    c.Ref(),
+		Target:  target,
+		Command: command,
+		Forced:  opts.force,
+	}
+
+	if err := c.Guard(entry.Time); err != nil {
+		if opts.override == "" {
+			log.Fatal(err, ". Use --override <reason> to run it anyway.")
+		}
+		fmt.Printf("%s, but it is overridden: %s\n\n", err, opts.override)
+		entry.Override = opts.override
+	}
+
+	if c.needsApproval() {
+		req := c.approvalRequest(target, command, hosts)
+		if opts.approval == "" {
+			fn, err := c.requestApproval(req)
+			if err != nil {
+				log.Fatal("Requesting approval failed: ", err)
+			}
+
+			fmt.Printf(
+				"The command has to be approved by someone else first. Have them run\n\n  sp approve %s\n\nand run the command again with --approval %s\n",
+				fn, fn,
+			)
+			os.Exit(1)
+		}
+
+		f, err := ReadApproval(opts.approval)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// The approval is only good for the one who requested it
+		key, err := loadSigningKey(c.repo.signingKey)
+		if err != nil {
+			log.Fatal("Reading your signing key failed: ", err)
+		}
+		req.Key = authorizedKey(key.PublicKey())
+
+		entry.ApprovedBy, err = c.repo.approvalPolicy().Check(f, req, time.Now())
+		if err != nil {
+			log.Fatal("Refusing to run the command: ", err)
+		}
+
+		entry.Approval = f.ID()
+		if used, err := approvalUsed(historyFilename(), entry.Approval); err != nil {
+			log.Fatal("Reading the history failed: ", err)
+		} else if used {
+			log.Fatal("Refusing to run the command: the approval has already been used; request a new one")
+		}
+		fmt.Printf("Approved by %s.\n\n", strings.Join(entry.ApprovedBy, ", "))
+	}
+
+	// Check the preconditions before asking, so that the answer can take them
+	// into account
+	if len(c.Preconditions) != 0 {
+		entry.Checks = c.runChecks(transport, PreCondition, c.Preconditions, target, hosts)
+		fmt.Println("Preconditions:")
+		if !PrintCheckResults(entry.Checks) {
+			if !opts.force {
+				recordRun(entry)
+				transport.Close()
+				log.Fatal("Refusing to run the command, since a precondition failed. Use --force to run it anyway.")
+			}
+			fmt.Println("A precondition failed, but the command is forced.")
+		}
+		fmt.Println()
+	}
+
+	if err := c.confirm(target, hosts, opts.yes); err == errDeclined {
 		fmt.Println("Doing nothing.")
 
+		entry.Declined = true
+		recordRun(entry)
+		transport.Close()
 		os.Exit(1)
+	} else if err != nil {
+		log.Fatal(err)
 	}
 
-	repo := c.repo.ParentRepo()
-	host := repo.GetHost(hostdef)
-	host.Execute(c.RawCommand)
-	return
+	entry.Results = c.Run(transport, hosts, command, os.Stdout)
+
+	// A single host speaks for itself, unless it took retries or its output
+	// was checked
+	passed := true
+	results := entry.Results
+	if len(results) > 1 || len(c.Expect) != 0 || results[0].Attempts > 1 || results[0].Status != StatusOK {
+		fmt.Println()
+		passed = PrintCommandResults(results)
+	}
+
+	if len(c.Postconditions) != 0 {
+		post := c.runChecks(transport, PostCondition, c.Postconditions, target, hosts)
+		entry.Checks = append(entry.Checks, post...)
+		fmt.Println("\nPostconditions:")
+		passed = PrintCheckResults(post) && passed
+	}
+
+	recordRun(entry)
+	if !passed {
+		transport.Close()
+		os.Exit(1)
+	}
+}
+
+// recordRun appends a run of a command or transfer to the history
+func recordRun(entry HistoryEntry) {
+	if err := RecordHistory(historyFilename(), entry); err != nil {
+		log.Println("Recording the run in the history failed: ", err)
+	}
+}
+
+// Run runs a command on each of the hosts in turn, retrying it on the hosts
+// that it fails or times out on
+func (c *Command) Run(transport Transport, hosts []*Host, command string, stdout io.Writer) []CommandResult {
+	results := make([]CommandResult, 0, len(hosts))
+	for _, host := range hosts {
+		result := CommandResult{Host: host.FQDN}
+		for {
+			result.Attempts++
+			result.Status, result.Detail = c.attempt(transport, host, command, stdout)
+			if result.Status == StatusOK || result.Attempts > c.Retries {
+				break
+			}
+			retrySleep(c.RetryDelay)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// attempt runs a command on a host once, and returns its status
+func (c *Command) attempt(transport Transport, host *Host, command string, stdout io.Writer) (string, string) {
+	ctx := context.Background()
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	var out strings.Builder
+	if len(c.Expect) != 0 {
+		stdout = &out
+	}
+
+	err := transport.Run(ctx, host, command, stdout, os.Stderr)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return StatusTimeout, fmt.Sprintf("timed out after %s", c.Timeout)
+	}
+
+	code, ok := exitCode(err)
+	if !ok {
+		return StatusFailed, err.Error()
+	}
+	if !c.okExitCode(code) {
+		return StatusFailed, fmt.Sprintf("exit code %d", code)
+	}
+
+	if len(c.Expect) == 0 {
+		return StatusOK, fmt.Sprintf("exit code %d", code)
+	}
+	if failures := checkExpect(c.Expect, out.String()); len(failures) != 0 {
+		return StatusFailed, strings.Join(failures, "; ")
+	}
+	return StatusOK, fmt.Sprintf("exit code %d, %d checks passed", code, len(c.Expect))
+}
+
+// okExitCode tells if an exit code counts as success
+func (c *Command) okExitCode(code int) bool {
+	if len(c.OkExitCodes) == 0 {
+		return code == 0
+	}
+	for _, ok := range c.OkExitCodes {
+		if code == ok {
+			return true
+		}
+	}
+	return false
+}
+
+// exitCode returns the exit code of a command from the error of running it,
+// and false if the command did not get to exit
+func exitCode(err error) (int, bool) {
+	if err == nil {
+		return 0, true
+	}
+
+	var sshErr *ssh.ExitError
+	if errors.As(err, &sshErr) {
+		return sshErr.ExitStatus(), true
+	}
+
+	var execErr *exec.ExitError
+	if errors.As(err, &execErr) && execErr.ExitCode() != -1 {
+		return execErr.ExitCode(), true
+	}
+	return 0, false
+}
+
+// PrintCommandResults prints a table of the results of a command and returns
+// whether it succeeded on all of the hosts
+func PrintCommandResults(results []CommandResult) bool {
+	ok := true
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tSTATUS\tATTEMPTS\tDETAIL")
+	for _, r := range results {
+		if r.Status != StatusOK {
+			ok = false
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", r.Host, colorStatus(r.Status), r.Attempts, r.Detail)
+	}
+	w.Flush()
+	return ok
+}
+
+// colorStatus colors the status of a command on a host
+func colorStatus(status string) string {
+	switch status {
+	case StatusOK:
+		return color.New(color.FgGreen, color.Bold).Sprint(status)
+	case StatusTimeout:
+		return color.New(color.FgYellow, color.Bold).Sprint(status)
+	}
+	return color.New(color.FgRed, color.Bold).Sprint(status)
+}
+
+// Ref returns the reference of the command, like `shop ops restart`
+func (c *Command) Ref() string {
+	return strings.Join(append(c.repo.PathKeys(), c.id), " ")
+}
+
+// Defaults returns the defaults of the repository of the command, with the
+// settings of the command itself on top
+func (c *Command) Defaults() Defaults {
+	return c.repo.defaults.Merge(Defaults{Confirm: c.Confirm, Vars: c.Vars})
 }
 
 // ID returns the ID of the item
@@ -110,12 +476,29 @@ func (c Command) Path() string {
 	return c.path
 }
 
+// Alias returns the alias of the item
+func (c Command) Alias() string {
+	return c.RawAlias
+}
+
 // Summary returns the summary of the item
 func (c Command) Summary() string {
 	// TODO(thiderman): This doesn't feel right...
 	return c.RawSummary
 }
 
+// References returns the `see_also` references of the item
+func (c Command) References() []string {
+	return c.SeeAlso
+}
+
 func (c *Command) getHosts(args cli.Args) (names []string) {
 	return
 }
+
+// bind sets the fields of the item that are not read from its file
+func (c *Command) bind(r *Repo, p string) {
+	c.id = asKey(p)
+	c.path = p
+	c.repo = r
+}
@@ -1 +1,221 @@
 package main
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// fakeTransport answers the commands it is asked to run with the errors it is
+// given, one per call. Calls after the last error succeed.
+type fakeTransport struct {
+	errs  []error
+	out   string
+	calls []string
+}
+
+func (t *fakeTransport) Run(ctx context.Context, host *Host, command string, stdout, stderr io.Writer) error {
+	t.calls = append(t.calls, host.FQDN)
+	io.WriteString(stdout, t.out)
+	if len(t.errs) == 0 {
+		return nil
+	}
+
+	err := t.errs[0]
+	t.errs = t.errs[1:]
+	if err == context.DeadlineExceeded {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return err
+}
+
+func (t *fakeTransport) Close() error {
+	return nil
+}
+
+func testHosts(fqdns ...string) []*Host {
+	hosts := make([]*Host, len(fqdns))
+	for x, fqdn := range fqdns {
+		hosts[x] = &Host{FQDN: fqdn}
+	}
+	return hosts
+}
+
+func TestCommandSettings(t *testing.T) {
+	assert := assert.New(t)
+
+	item, err := ResolveRef(testParentRepos(), "shop ops healthcheck")
+	assert.Nil(err)
+
+	c := item.(*Command)
+	assert.Equal(30*time.Second, c.Timeout)
+	assert.Equal(3, c.Retries)
+	assert.Equal(5*time.Second, c.RetryDelay)
+	assert.Equal([]int{0, 22}, c.OkExitCodes)
+	assert.Equal(2, len(c.Expect))
+	assert.Equal("replication lag", c.Expect[1].String())
+	assert.Equal(30.0, *c.Expect[1].Max)
+}
+
+func TestCommandRun(t *testing.T) {
+	assert := assert.New(t)
+
+	tr := &fakeTransport{errs: []error{nil, errors.New("ssh: handshake failed")}}
+	c := &Command{}
+
+	results := c.Run(tr, testHosts("db1", "db2"), "uptime", ioutil.Discard)
+	assert.Equal([]CommandResult{
+		{Host: "db1", Status: StatusOK, Attempts: 1, Detail: "exit code 0"},
+		{Host: "db2", Status: StatusFailed, Attempts: 1, Detail: "ssh: handshake failed"},
+	}, results)
+	assert.False(PrintCommandResults(results))
+}
+
+func TestCommandRetries(t *testing.T) {
+	assert := assert.New(t)
+
+	var slept []time.Duration
+	retrySleep = func(d time.Duration) { slept = append(slept, d) }
+	defer func() { retrySleep = time.Sleep }()
+
+	failure := errors.New("connection refused")
+	tr := &fakeTransport{errs: []error{failure, failure, nil, failure, failure, failure}}
+	c := &Command{Retries: 2, RetryDelay: time.Second}
+
+	results := c.Run(tr, testHosts("db1", "db2"), "uptime", ioutil.Discard)
+	assert.Equal(StatusOK, results[0].Status)
+	assert.Equal(3, results[0].Attempts)
+	assert.Equal(StatusFailed, results[1].Status)
+	assert.Equal(3, results[1].Attempts)
+	assert.Equal([]string{"db1", "db1", "db1", "db2", "db2", "db2"}, tr.calls)
+	assert.Equal([]time.Duration{time.Second, time.Second, time.Second, time.Second}, slept)
+}
+
+func TestCommandTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	tr := &fakeTransport{errs: []error{context.DeadlineExceeded}}
+	c := &Command{Timeout: 10 * time.Millisecond}
+
+	results := c.Run(tr, testHosts("db1", "db2"), "sleep 60", ioutil.Discard)
+	assert.Equal(CommandResult{Host: "db1", Status: StatusTimeout, Attempts: 1, Detail: "timed out after 10ms"}, results[0])
+	assert.Equal(StatusOK, results[1].Status)
+	assert.False(PrintCommandResults(results))
+	assert.True(PrintCommandResults(results[1:]))
+}
+
+func TestCommandExitCodes(t *testing.T) {
+	assert := assert.New(t)
+
+	tr, identity, srvs := testTransport(t, func(key ssh.PublicKey) []*testSSHServer {
+		return []*testSSHServer{newTestSSHServer(t, key)}
+	})
+	hosts := []*Host{testSSHHost(srvs[0].port(), identity)}
+
+	c := &Command{}
+	results := c.Run(tr, hosts, "exit 22", ioutil.Discard)
+	assert.Equal(StatusFailed, results[0].Status)
+	assert.Equal("exit code 22", results[0].Detail)
+
+	c.OkExitCodes = []int{0, 22}
+	results = c.Run(tr, hosts, "exit 22", ioutil.Discard)
+	assert.Equal(StatusOK, results[0].Status)
+	assert.Equal("exit code 22", results[0].Detail)
+
+	results = c.Run(tr, hosts, "exit 1", ioutil.Discard)
+	assert.Equal(StatusFailed, results[0].Status)
+}
+
+func TestCommandExpect(t *testing.T) {
+	assert := assert.New(t)
+
+	tr := &fakeTransport{out: replicationOutput}
+	c := &Command{Expect: []Expect{
+		{Match: "Slave_IO_Running: Yes"},
+		{Name: "lag", Value: `Seconds_Behind_Master: (\d+)`, Max: float(30)},
+	}}
+
+	results := c.Run(tr, testHosts("db1"), "show slave status", ioutil.Discard)
+	assert.Equal(StatusOK, results[0].Status)
+	assert.Equal("exit code 0, 2 checks passed", results[0].Detail)
+
+	c.Expect[1].Max = float(5)
+	c.Expect = append(c.Expect, Expect{NotMatch: "Running: Yes"})
+	results = c.Run(tr, testHosts("db1"), "show slave status", ioutil.Discard)
+	assert.Equal(StatusFailed, results[0].Status)
+	assert.Equal(`lag: 12 is above 5; not_match "Running: Yes": matched "Running: Yes"`, results[0].Detail)
+}
+
+func TestCommandChecks(t *testing.T) {
+	assert := assert.New(t)
+
+	item, err := ResolveRef(testParentRepos(), "shop ops failover")
+	assert.Nil(err)
+	c := item.(*Command)
+
+	hosts, err := c.repo.GetHosts(c.Hosts["db"])
+	assert.Nil(err)
+
+	// The health check passes, but the host is not in recovery
+	tr := &fakeTransport{out: clusterOutput}
+	results := c.runChecks(tr, PreCondition, c.Preconditions, "db", hosts)
+	assert.Equal(2, len(results))
+	assert.Equal("shop ops healthcheck", results[0].Check)
+	assert.Equal(PreCondition, results[0].Phase)
+	assert.True(results[0].Passed())
+	assert.Equal("not the primary", results[1].Check)
+	assert.False(results[1].Passed())
+	assert.Equal(`match "^t": no match`, results[1].Results[0].Detail)
+	assert.False(PrintCheckResults(results))
+
+	tr = &fakeTransport{out: "t\n"}
+	results = c.runChecks(tr, PreCondition, c.Preconditions[1:], "db", hosts)
+	assert.True(PrintCheckResults(results))
+	assert.Equal([]string{"shop-db1.example.com"}, tr.calls)
+
+	for _, check := range append(c.Preconditions, c.Postconditions...) {
+		assert.Nil(c.validateCheck(check))
+	}
+}
+
+func TestCommandInvalidChecks(t *testing.T) {
+	assert := assert.New(t)
+
+	item, _ := ResolveRef(testParentRepos(), "shop ops failover")
+	c := item.(*Command)
+
+	assert.EqualError(c.validateCheck(Check{}), "checks need exactly one of run and command")
+	assert.EqualError(
+		c.validateCheck(Check{Command: "shop ops healthcheck", Target: "web"}),
+		`shop ops healthcheck has no host target "web"`,
+	)
+	assert.EqualError(
+		c.validateCheck(Check{Command: "shop hosts db"}),
+		"shop hosts db is not a command",
+	)
+	assert.NotNil(c.validateCheck(Check{Command: "shop ops nowhere"}))
+
+	// Checks would run other commands without confirmation or approval
+	assert.EqualError(
+		c.validateCheck(Check{Command: "shop ops failover"}),
+		"shop ops failover is destructive; checks can only run read-only commands",
+	)
+	tr := &fakeTransport{}
+	results := c.runChecks(tr, PreCondition, []Check{{Command: "shop ops failover"}}, "db", nil)
+	assert.False(results[0].Passed())
+	assert.Empty(tr.calls)
+
+	results = c.runChecks(&fakeTransport{}, PostCondition, []Check{{Command: "shop ops nowhere"}}, "db", nil)
+	assert.False(results[0].Passed())
+	assert.NotEmpty(results[0].Error)
+
+	results = c.runChecks(tr, PreCondition, []Check{{Name: "nothing"}}, "db", []*Host{{FQDN: "shop-db1.example.com"}})
+	assert.Equal("checks need exactly one of run and command", results[0].Error)
+	assert.Empty(tr.calls)
+}
@@ -1,9 +1,10 @@
 package main
 
 import (
+	"bytes"
 	"io/ioutil"
 
-	"gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
 	"os"
 	"os/user"
 	"path/filepath"
@@ -11,9 +12,75 @@ import (
 
 // Config contains the root configuration of a project
 type Config struct {
-	RepoRoot     string   `yaml:"repository_root"`
-	Repositories []string `yaml:"repositories"`
-	filename     string
+	RepoRoot     string       `yaml:"repository_root"`
+	Repositories []RepoConfig `yaml:"repositories"`
+	SSH          SSHConfig    `yaml:"ssh,omitempty"`
+
+	// YesRisk is the highest risk of commands that --yes runs without asking
+	YesRisk string `yaml:"yes_risk,omitempty"`
+
+	// SigningKey is the private key that approvals are requested and given
+	// with, ~/.ssh/id_ed25519 by default
+	SigningKey string `yaml:"signing_key,omitempty"`
+
+	filename string
+	cache    string
+}
+
+// RepoConfig is the configuration of a single repository, written as just its
+// path when nothing else is set
+type RepoConfig struct {
+	Path      string `yaml:"path"`
+	Key       string `yaml:"key,omitempty"`
+	Namespace string `yaml:"namespace,omitempty"`
+	Branch    string `yaml:"branch,omitempty"`
+	Ref       string `yaml:"ref,omitempty"`
+	Type      string `yaml:"type,omitempty"`
+	Source    string `yaml:"source,omitempty"`
+
+	Verify *SignaturePolicy `yaml:"verify,omitempty"`
+}
+
+// UnmarshalYAML allows a repository to be configured as only a path
+func (rc *RepoConfig) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		rc.Path = node.Value
+		return nil
+	}
+
+	// The plain type does not have the UnmarshalYAML method, so we can
+	// decode the mapping into it without recursing back into here.
+	type plain RepoConfig
+	return node.Decode((*plain)(rc))
+}
+
+// MarshalYAML writes repositories without any extra settings as only a path
+func (rc RepoConfig) MarshalYAML() (interface{}, error) {
+	if rc == (RepoConfig{Path: rc.Path}) {
+		return rc.Path, nil
+	}
+
+	type plain RepoConfig
+	return plain(rc), nil
+}
+
+// RepoKey applies the key and namespace settings to the key that a repository
+// declares itself, making it `namespace/key`
+func (rc RepoConfig) RepoKey(declared string) string {
+	key := declared
+	if rc.Key != "" {
+		key = rc.Key
+	}
+
+	if rc.Namespace != "" {
+		key = rc.Namespace + "/" + key
+	}
+	return key
+}
+
+// LoadedKey returns the key that LoadRepos gives the repository
+func (rc RepoConfig) LoadedKey() string {
+	return rc.RepoKey(declaredKey(rc.Path))
 }
 
 // LoadConfig checks for configuration files and loads them
@@ -30,23 +97,39 @@ func LoadConfig(fn string) *Config {
 
 		return &Config{
 			RepoRoot:     root,
-			Repositories: []string{},
+			Repositories: []RepoConfig{},
 			filename:     fn,
+			cache:        cacheFilename(),
 		}
 	}
 
-	c := Config{filename: fn}
+	c := Config{filename: fn, cache: cacheFilename()}
 	yaml.Unmarshal(data, &c)
 
 	return &c
 }
 
+// cacheFilename returns where the item cache is stored, or an empty string if
+// there is no cache. $SAGACITY_CACHE overrides it.
+func cacheFilename() string {
+	if fn := os.Getenv("SAGACITY_CACHE"); fn != "" {
+		return fn
+	}
+
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "sagacity", "items.cache")
+}
+
 // persist saves the file to disk
 func (c *Config) persist() error {
-	// Create the directory if it doesn't exist
+	// Create the directories if they don't exist
 	os.MkdirAll(c.RepoRoot, 0755)
+	os.MkdirAll(filepath.Dir(c.filename), 0755)
 
-	d, err := yaml.Marshal(c)
+	d, err := c.marshal()
 	if err != nil {
 		return err
 	}
@@ -59,8 +142,41 @@ func (c *Config) persist() error {
 	return nil
 }
 
+// marshal encodes the config as YAML, indented like people tend to write it
+func (c *Config) marshal() ([]byte, error) {
+	var buf bytes.Buffer
+
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(c); err != nil {
+		return nil, err
+	}
+
+	err := enc.Close()
+	return buf.Bytes(), err
+}
+
 // AddRepo adds a new repository to the config and saves the YAML
-func (c *Config) AddRepo(dir string) error {
-	c.Repositories = append(c.Repositories, dir)
+func (c *Config) AddRepo(rc RepoConfig) error {
+	c.Repositories = append(c.Repositories, rc)
+	return c.persist()
+}
+
+// RemoveRepo removes the repository at index x from the config and saves the YAML
+func (c *Config) RemoveRepo(x int) error {
+	c.Repositories = append(c.Repositories[:x], c.Repositories[x+1:]...)
+	return c.persist()
+}
+
+// SetRepoPath changes the path of the repository at index x and saves the YAML
+func (c *Config) SetRepoPath(x int, path string) error {
+	c.Repositories[x].Path = path
+	return c.persist()
+}
+
+// SetRepoRef pins the repository at index x to a ref, or unpins it if the ref is
+// empty, and saves the YAML
+func (c *Config) SetRepoRef(x int, ref string) error {
+	c.Repositories[x].Ref = ref
 	return c.persist()
 }
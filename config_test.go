@@ -2,6 +2,9 @@ package main
 
 import (
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -22,9 +25,66 @@ func TestLoadConfigFileDoesExist(t *testing.T) {
 	c := LoadConfig(fn)
 
 	assert.Equal(2, len(c.Repositories))
-	assert.Equal("/whisky/in/the/jar", c.Repositories[0])
-	assert.Equal("/rapunzel/hair", c.Repositories[1])
+	assert.Equal("/whisky/in/the/jar", c.Repositories[0].Path)
+	assert.Equal("/rapunzel/hair", c.Repositories[1].Path)
 
 	assert.Equal(fn, c.filename)
 	assert.Equal("/fiddler/on/the/green", c.RepoRoot)
 }
+
+func TestLoadConfigCacheOverride(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Setenv("SAGACITY_CACHE", "/tmp/sagacity-test/items.cache")
+	assert.Equal("/tmp/sagacity-test/items.cache", LoadConfig("nonexistant/config.yaml").cache)
+	assert.Equal("/tmp/sagacity-test/items.cache", LoadConfig("test/config_load_test.yaml").cache)
+}
+
+func TestLoadConfigRepositorySettings(t *testing.T) {
+	assert := assert.New(t)
+	c := LoadConfig("test/config_repo_settings_test.yaml")
+
+	assert.Equal(RepoConfig{Path: "/whisky/in/the/jar"}, c.Repositories[0])
+	assert.Equal(RepoConfig{Path: "/rapunzel/hair", Key: "hair", Namespace: "grimm"}, c.Repositories[1])
+}
+
+func TestRepoConfigMarshalsPlainPaths(t *testing.T) {
+	assert := assert.New(t)
+	c := Config{Repositories: []RepoConfig{
+		{Path: "/whisky/in/the/jar"},
+		{Path: "/rapunzel/hair", Namespace: "grimm"},
+	}}
+
+	data, err := c.marshal()
+
+	assert.Nil(err)
+	assert.Contains(string(data), "- /whisky/in/the/jar\n")
+	assert.Contains(string(data), "  - path: /rapunzel/hair\n    namespace: grimm\n")
+}
+
+func TestRepoConfigRepoKey(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("topic", RepoConfig{}.RepoKey("topic"))
+	assert.Equal("other", RepoConfig{Key: "other"}.RepoKey("topic"))
+	assert.Equal("team/topic", RepoConfig{Namespace: "team"}.RepoKey("topic"))
+	assert.Equal("team/other", RepoConfig{Key: "other", Namespace: "team"}.RepoKey("topic"))
+}
+
+func TestRepoConfigLoadedKey(t *testing.T) {
+	assert := assert.New(t)
+
+	// The key in _repo.yaml wins over the directory name, as when loading
+	dir := filepath.Join(t.TempDir(), "kb-topic")
+	os.Mkdir(dir, 0755)
+	ioutil.WriteFile(filepath.Join(dir, "_repo.yaml"), []byte("key: topic\n"), 0644)
+
+	c := &Config{Repositories: []RepoConfig{{Path: dir, Namespace: "team"}}}
+	repos, _ := LoadRepos(c)
+	assert.Contains(repos, "team/topic")
+	assert.Equal("team/topic", c.Repositories[0].LoadedKey())
+
+	ioutil.WriteFile(filepath.Join(dir, "_repo.yaml"), []byte("summary: No key\n"), 0644)
+	assert.Equal("team/kb-topic", c.Repositories[0].LoadedKey())
+	assert.Equal("other", RepoConfig{Path: dir, Key: "other"}.LoadedKey())
+}
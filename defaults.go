@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The control files that give a repository and its subrepos their settings
+const (
+	defaultsFile = "_defaults.yaml"
+	ignoreFile   = "_ignore.yaml"
+)
+
+// Defaults are the settings in a _defaults.yaml file, which apply to its
+// repository and subrepos
+type Defaults struct {
+	SSH SSHSettings `yaml:"ssh"`
+
+	// Confirm is whether commands ask before running. They do unless told
+	// otherwise.
+	Confirm *bool `yaml:"confirm"`
+
+	// Vars are substituted for {{name}} in commands and info bodies
+	Vars map[string]string `yaml:"vars"`
+}
+
+// SSHSettings are the settings used when connecting to hosts
+type SSHSettings struct {
+	User      string   `yaml:"user"`
+	Port      int      `yaml:"port"`
+	Identity  string   `yaml:"identity"`
+	ProxyJump string   `yaml:"proxy_jump"` // [user@]host[:port], like ssh -J
+	Options   []string `yaml:"options"`    // given to ssh as -o <option>
+}
+
+// Merge returns the defaults with the settings of `o` on top. Vars are merged key
+// by key, while lists are replaced as a whole.
+func (d Defaults) Merge(o Defaults) Defaults {
+	d.SSH = d.SSH.Merge(o.SSH)
+
+	if o.Confirm != nil {
+		d.Confirm = o.Confirm
+	}
+
+	if len(o.Vars) != 0 {
+		vars := make(map[string]string, len(d.Vars)+len(o.Vars))
+		for k, v := range d.Vars {
+			vars[k] = v
+		}
+		for k, v := range o.Vars {
+			vars[k] = v
+		}
+		d.Vars = vars
+	}
+
+	return d
+}
+
+// Confirms returns whether commands should ask before running
+func (d Defaults) Confirms() bool {
+	return d.Confirm == nil || *d.Confirm
+}
+
+// Merge returns the settings with the ones that are set in `o` on top
+func (s SSHSettings) Merge(o SSHSettings) SSHSettings {
+	if o.User != "" {
+		s.User = o.User
+	}
+	if o.Port != 0 {
+		s.Port = o.Port
+	}
+	if o.Identity != "" {
+		s.Identity = o.Identity
+	}
+	if o.ProxyJump != "" {
+		s.ProxyJump = o.ProxyJump
+	}
+	if len(o.Options) != 0 {
+		s.Options = o.Options
+	}
+	return s
+}
+
+// Args returns the ssh arguments for the settings
+func (s SSHSettings) Args() (args []string) {
+	if s.User != "" {
+		args = append(args, "-l", s.User)
+	}
+	if s.Port != 0 {
+		args = append(args, "-p", strconv.Itoa(s.Port))
+	}
+	if s.Identity != "" {
+		args = append(args, "-i", s.Identity)
+	}
+	if s.ProxyJump != "" {
+		args = append(args, "-J", s.ProxyJump)
+	}
+	for _, opt := range s.Options {
+		args = append(args, "-o", opt)
+	}
+	return
+}
+
+// varRxp matches {{name}}. Anything else in braces, like the {{.Names}} of a
+// `docker ps --format`, is left alone.
+var varRxp = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_-]+)\s*\}\}`)
+
+// expandVars substitutes the vars into a string. Unknown vars are left as is.
+func expandVars(s string, vars map[string]string) string {
+	if len(vars) == 0 {
+		return s
+	}
+
+	return varRxp.ReplaceAllStringFunc(s, func(m string) string {
+		if v, ok := vars[varRxp.FindStringSubmatch(m)[1]]; ok {
+			return v
+		}
+		return m
+	})
+}
+
+// Ignore is the contents of an _ignore.yaml file
+type Ignore struct {
+	// Patterns are shell patterns of files to skip. Those with a slash match
+	// paths relative to the _ignore.yaml, the others names at any depth.
+	Patterns []string `yaml:"patterns"`
+}
+
+// ignoreRule is an ignore pattern and the directory it was declared in
+type ignoreRule struct {
+	dir     string
+	pattern string
+}
+
+// ignored tells if a file or directory is matched by any of the rules
+func ignored(rules []ignoreRule, p string) bool {
+	for _, rule := range rules {
+		name := filepath.Base(p)
+		if strings.Contains(rule.pattern, "/") {
+			rel, err := filepath.Rel(rule.dir, p)
+			if err != nil {
+				continue
+			}
+			name = filepath.ToSlash(rel)
+		}
+
+		if ok, _ := filepath.Match(rule.pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// readControl decodes a control file of a directory into `out`. Missing
+// files are not an error.
+func readControl(dir, name string, out interface{}) error {
+	data, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := yaml.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("%s: %s", filepath.Join(dir, name), err)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// deepRepos returns the repos of the test/deep fixture, from the top down
+func deepRepos() []*Repo {
+	r := NewRepo("test/deep/")
+	repos := []*Repo{r}
+	for _, key := range []string{"one", "two", "three", "four", "five"} {
+		r = r.Subrepos[key]
+		repos = append(repos, r)
+	}
+	return repos
+}
+
+func TestDefaultsCascadeToSubrepos(t *testing.T) {
+	assert := assert.New(t)
+	repos := deepRepos()
+
+	root := repos[0].defaults
+	assert.Equal("ops", root.SSH.User)
+	assert.Equal(2222, root.SSH.Port)
+	assert.True(root.Confirms())
+	assert.Equal("production", root.Vars["env"])
+
+	// one has no _defaults.yaml and gets the ones of the root
+	assert.Equal(root, repos[1].defaults)
+
+	// two overrides some of them, which its subrepos get as well
+	for _, r := range repos[2:] {
+		assert.Equal("deploy", r.defaults.SSH.User)
+		assert.Equal(2222, r.defaults.SSH.Port)
+		assert.Equal([]string{"StrictHostKeyChecking=yes"}, r.defaults.SSH.Options)
+		assert.False(r.defaults.Confirms())
+		assert.Equal(map[string]string{"env": "staging", "region": "eu-west-1"}, r.defaults.Vars)
+	}
+}
+
+func TestIgnorePatterns(t *testing.T) {
+	assert := assert.New(t)
+	repos := deepRepos()
+
+	// Ignored by the name pattern of the root, at any depth
+	_, ok := repos[1].Subrepos["scratch"]
+	assert.False(ok)
+
+	// Ignored by the patterns of three
+	five := repos[5]
+	assert.Equal([]string{"deepest"}, five.Keys())
+	assert.Equal(0, len(five.Subrepos))
+}
+
+func TestItemsUseDefaults(t *testing.T) {
+	assert := assert.New(t)
+	five := deepRepos()[5]
+
+	confirm := true
+	c := &Command{RawCommand: "deploy {{env}} {{region}} {{.Names}}", Confirm: &confirm, Vars: map[string]string{"region": "us-east-1"}}
+	c.bind(five, "test/deep/one/two/three/four/five/deploy.yaml")
+
+	d := c.Defaults()
+	assert.True(d.Confirms())
+	assert.Equal("deploy staging us-east-1 {{.Names}}", expandVars(c.RawCommand, d.Vars))
+
+	h := &HostInfo{Types: HostType{"db": Category{Hosts: []Host{
+		{FQDN: "db1"},
+		{FQDN: "db2", SSH: SSHSettings{User: "postgres"}},
+	}}}}
+	h.bind(five, "test/deep/one/two/three/four/five/hosts.yaml")
+
+	cat := h.Types["db"]
+	assert.Equal([]string{"-l", "deploy", "-p", "2222", "-o", "StrictHostKeyChecking=yes"}, cat.Hosts[0].Settings().Args())
+	assert.Equal("postgres", cat.GetHost("db2").Settings().User)
+	assert.Equal(2222, cat.PrimaryHost().Settings().Port)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Expect is a rule that the output of a command must follow: a regexp that must
+// match or not, or bounds for a value found by a regexp group or a JSON path
+type Expect struct {
+	Name     string   `yaml:"name"`
+	Match    string   `yaml:"match"`
+	NotMatch string   `yaml:"not_match"`
+	Value    string   `yaml:"value"`
+	JSON     string   `yaml:"json"`
+	Min      *float64 `yaml:"min"`
+	Max      *float64 `yaml:"max"`
+	Equals   *string  `yaml:"equals"`
+}
+
+// String describes the rule, by its name if it has one
+func (e Expect) String() string {
+	switch {
+	case e.Name != "":
+		return e.Name
+	case e.Match != "":
+		return fmt.Sprintf("match %q", e.Match)
+	case e.NotMatch != "":
+		return fmt.Sprintf("not_match %q", e.NotMatch)
+	case e.Value != "":
+		return fmt.Sprintf("value %q", e.Value)
+	}
+	return fmt.Sprintf("json %q", e.JSON)
+}
+
+// Validate checks that the rule checks exactly one thing, and can
+func (e Expect) Validate() error {
+	kinds := 0
+	for _, s := range []string{e.Match, e.NotMatch, e.Value, e.JSON} {
+		if s != "" {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return errors.New("expect rules need exactly one of match, not_match, value and json")
+	}
+
+	if (e.Min != nil || e.Max != nil || e.Equals != nil) && e.Value == "" && e.JSON == "" {
+		return fmt.Errorf("%s: min, max and equals only apply to value and json", e)
+	}
+
+	for _, rxp := range []string{e.Match, e.NotMatch, e.Value} {
+		if _, err := regexp.Compile(rxp); err != nil {
+			return fmt.Errorf("%s: %s", e, err)
+		}
+	}
+
+	if e.Value != "" && regexp.MustCompile(e.Value).NumSubexp() == 0 {
+		return fmt.Errorf("%s: the regexp needs a group to capture the value", e)
+	}
+	return nil
+}
+
+// Check checks the output of a command against the rule
+func (e Expect) Check(out string) error {
+	if err := e.Validate(); err != nil {
+		return err
+	}
+
+	switch {
+	case e.Match != "":
+		if !regexp.MustCompile(e.Match).MatchString(out) {
+			return fmt.Errorf("%s: no match", e)
+		}
+		return nil
+
+	case e.NotMatch != "":
+		if m := regexp.MustCompile(e.NotMatch).FindString(out); m != "" {
+			return fmt.Errorf("%s: matched %q", e, m)
+		}
+		return nil
+
+	case e.Value != "":
+		m := regexp.MustCompile(e.Value).FindStringSubmatch(out)
+		if m == nil {
+			return fmt.Errorf("%s: no match", e)
+		}
+		return e.compare(m[1])
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal([]byte(out), &doc); err != nil {
+		return fmt.Errorf("%s: the output is not JSON: %s", e, err)
+	}
+
+	v, err := jsonPath(doc, e.JSON)
+	if err != nil {
+		return fmt.Errorf("%s: %s", e, err)
+	}
+
+	switch v := v.(type) {
+	case string:
+		return e.compare(v)
+	case map[string]interface{}, []interface{}:
+		if e.Min != nil || e.Max != nil || e.Equals != nil {
+			return fmt.Errorf("%s: not a single value", e)
+		}
+		return nil
+	default:
+		// Numbers, booleans and null are compared the way they are written
+		data, _ := json.Marshal(v)
+		return e.compare(string(data))
+	}
+}
+
+// compare checks a value against the bounds of the rule
+func (e Expect) compare(v string) error {
+	if e.Equals != nil && v != *e.Equals {
+		return fmt.Errorf("%s: got %q, want %q", e, v, *e.Equals)
+	}
+
+	if e.Min == nil && e.Max == nil {
+		return nil
+	}
+
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return fmt.Errorf("%s: %q is not a number", e, v)
+	}
+	if e.Min != nil && n < *e.Min {
+		return fmt.Errorf("%s: %s is below %g", e, v, *e.Min)
+	}
+	if e.Max != nil && n > *e.Max {
+		return fmt.Errorf("%s: %s is above %g", e, v, *e.Max)
+	}
+	return nil
+}
+
+// jsonPath finds the value at a dotted path in a decoded JSON document.
+// Array elements are given by their index.
+func jsonPath(doc interface{}, path string) (interface{}, error) {
+	v := doc
+	for _, key := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			next, ok := node[key]
+			if !ok {
+				return nil, fmt.Errorf("no %q in the output", path)
+			}
+			v = next
+
+		case []interface{}:
+			x, err := strconv.Atoi(key)
+			if err != nil || x < 0 || x >= len(node) {
+				return nil, fmt.Errorf("no %q in the output", path)
+			}
+			v = node[x]
+
+		default:
+			return nil, fmt.Errorf("no %q in the output", path)
+		}
+	}
+	return v, nil
+}
+
+// checkExpect checks output against all of the rules, and returns the
+// problems found
+func checkExpect(rules []Expect, out string) (failures []string) {
+	for _, rule := range rules {
+		if err := rule.Check(out); err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+	return
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+const replicationOutput = `Slave_IO_Running: Yes
+Slave_SQL_Running: Yes
+Seconds_Behind_Master: 12
+`
+
+const clusterOutput = `{"status": "green", "replication": {"lag": 3.5}, "nodes": [{"name": "db1", "up": true}]}`
+
+func float(f float64) *float64 {
+	return &f
+}
+
+func str(s string) *string {
+	return &s
+}
+
+func TestExpectRegexps(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(Expect{Match: `Slave_IO_Running: Yes`}.Check(replicationOutput))
+	assert.EqualError(
+		Expect{Match: `Slave_IO_Running: No`}.Check(replicationOutput),
+		`match "Slave_IO_Running: No": no match`,
+	)
+
+	assert.Nil(Expect{NotMatch: `ERROR`}.Check(replicationOutput))
+	assert.EqualError(
+		Expect{Name: "replication runs", NotMatch: `Running: \w+`}.Check(replicationOutput),
+		`replication runs: matched "Running: Yes"`,
+	)
+}
+
+func TestExpectValues(t *testing.T) {
+	assert := assert.New(t)
+
+	lag := `Seconds_Behind_Master: (\d+)`
+	assert.Nil(Expect{Value: lag, Max: float(30)}.Check(replicationOutput))
+	assert.Nil(Expect{Value: lag, Min: float(0), Max: float(12)}.Check(replicationOutput))
+	assert.EqualError(
+		Expect{Name: "lag", Value: lag, Max: float(10)}.Check(replicationOutput),
+		"lag: 12 is above 10",
+	)
+	assert.EqualError(
+		Expect{Name: "lag", Value: lag, Min: float(20)}.Check(replicationOutput),
+		"lag: 12 is below 20",
+	)
+	assert.EqualError(
+		Expect{Name: "lag", Value: `Lag: (\d+)`}.Check(replicationOutput),
+		"lag: no match",
+	)
+	assert.EqualError(
+		Expect{Name: "io", Value: `Slave_IO_Running: (\w+)`, Max: float(1)}.Check(replicationOutput),
+		`io: "Yes" is not a number`,
+	)
+	assert.Nil(Expect{Value: `Slave_IO_Running: (\w+)`, Equals: str("Yes")}.Check(replicationOutput))
+}
+
+func TestExpectJSON(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(Expect{JSON: "status", Equals: str("green")}.Check(clusterOutput))
+	assert.Nil(Expect{JSON: "replication.lag", Max: float(5)}.Check(clusterOutput))
+	assert.Nil(Expect{JSON: "nodes.0.up", Equals: str("true")}.Check(clusterOutput))
+	assert.Nil(Expect{JSON: "nodes"}.Check(clusterOutput))
+
+	assert.EqualError(
+		Expect{JSON: "replication.lag", Max: float(1)}.Check(clusterOutput),
+		`json "replication.lag": 3.5 is above 1`,
+	)
+	assert.EqualError(
+		Expect{JSON: "nodes.1.up"}.Check(clusterOutput),
+		`json "nodes.1.up": no "nodes.1.up" in the output`,
+	)
+	assert.EqualError(
+		Expect{JSON: "status", Equals: str("red")}.Check(clusterOutput),
+		`json "status": got "green", want "red"`,
+	)
+	assert.Contains(Expect{JSON: "status"}.Check(replicationOutput).Error(), "the output is not JSON")
+}
+
+func TestExpectValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(Expect{Match: "ok"}.Validate())
+	assert.NotNil(Expect{}.Validate())
+	assert.NotNil(Expect{Match: "ok", JSON: "status"}.Validate())
+	assert.NotNil(Expect{Match: "("}.Validate())
+	assert.NotNil(Expect{Match: "ok", Max: float(1)}.Validate())
+	assert.EqualError(
+		Expect{Value: `lag: \d+`}.Validate(),
+		`value "lag: \\d+": the regexp needs a group to capture the value`,
+	)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+)
+
+// HistoryEntry is a run of a command, as recorded in the history
+type HistoryEntry struct {
+	Time    time.Time `json:"time"`
+	User    string    `json:"user"`
+	Item    string    `json:"item"`
+	Target  string    `json:"target"`
+	Command string    `json:"command"`
+	Forced  bool      `json:"forced,omitempty"`
+
+	// Declined is set when the run was not confirmed, so nothing ran
+	Declined bool `json:"declined,omitempty"`
+
+	// Override is why the command was run outside of its maintenance windows
+	Override string `json:"override,omitempty"`
+
+	// ApprovedBy are who approved the run, for commands that need approval
+	ApprovedBy []string `json:"approved_by,omitempty"`
+	Approval   string   `json:"approval,omitempty"`
+
+	Results []CommandResult `json:"results"`
+	Checks  []CheckResult   `json:"checks,omitempty"`
+}
+
+// OK tells if the command succeeded on all of its hosts, and all of its
+// checks passed
+func (e HistoryEntry) OK() bool {
+	for _, r := range e.Results {
+		if r.Status != StatusOK {
+			return false
+		}
+	}
+	return checksPassed(e.Checks)
+}
+
+// Status summarizes the run: ok, failed, or refused if the command did not
+// run because a precondition failed or it was declined
+func (e HistoryEntry) Status() string {
+	switch {
+	case e.Declined:
+		return StatusRefused
+	case e.OK():
+		return StatusOK
+	case len(e.Results) == 0:
+		return StatusRefused
+	}
+	return StatusFailed
+}
+
+// historyFilename returns where the history is kept, in the XDG state directory
+// so that it survives cleaning the cache
+func historyFilename() string {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			home = os.TempDir()
+		}
+		dir = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(dir, "sagacity", "history.jsonl")
+}
+
+// currentUser returns the name of the user running sagacity
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// RecordHistory appends an entry to the history file, as a line of JSON
+func RecordHistory(fn string, e HistoryEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(fn, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	// A single write per entry keeps concurrent runs from interleaving
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ReadHistory reads the last `limit` entries of the history file, or all of them
+// for 0, skipping lines that cannot be read
+func ReadHistory(fn string, limit int) ([]HistoryEntry, error) {
+	f, err := os.Open(fn)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []HistoryEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		var e HistoryEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	return entries, scanner.Err()
+}
+
+// PrintHistory prints the entries of the history as a table
+func PrintHistory(entries []HistoryEntry) {
+	if len(entries) == 0 {
+		fmt.Println("No commands have been run yet.")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tUSER\tCOMMAND\tTARGET\tSTATUS\tHOSTS")
+	for _, e := range entries {
+		status := colorStatus(e.Status())
+		if e.Forced {
+			status += " (forced)"
+		}
+		if e.Override != "" {
+			status += " (overridden)"
+		}
+		if e.Declined {
+			status += " (declined)"
+		}
+
+		fmt.Fprintf(
+			w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			e.Time.Local().Format("2006-01-02 15:04:05"), e.User,
+			e.Item, e.Target, status, historyHosts(e.Results),
+		)
+	}
+	w.Flush()
+}
+
+// historyHosts summarizes the results of a command, like `2 ok, 1 timeout`
+func historyHosts(results []CommandResult) string {
+	counts := make(map[string]int)
+	for _, r := range results {
+		counts[r.Status]++
+	}
+
+	var s string
+	for _, status := range []string{StatusOK, StatusFailed, StatusTimeout} {
+		if counts[status] == 0 {
+			continue
+		}
+		if s != "" {
+			s += ", "
+		}
+		s += fmt.Sprintf("%d %s", counts[status], status)
+	}
+	return s
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, _ := ioutil.TempDir("", "sagacity")
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "state", "history.jsonl")
+
+	entries, err := ReadHistory(fn, 0)
+	assert.Nil(err)
+	assert.Empty(entries)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	for _, target := range []string{"db", "web", "cache"} {
+		err := RecordHistory(fn, HistoryEntry{
+			Time:    now,
+			User:    "ops",
+			Item:    "shop ops healthcheck",
+			Target:  target,
+			Command: "check",
+			Results: []CommandResult{
+				{Host: target + "1", Status: StatusOK, Attempts: 1},
+				{Host: target + "2", Status: StatusTimeout, Attempts: 2},
+			},
+		})
+		assert.Nil(err)
+	}
+
+	entries, err = ReadHistory(fn, 0)
+	assert.Nil(err)
+	assert.Equal(3, len(entries))
+	assert.Equal(now, entries[0].Time)
+	assert.Equal(StatusTimeout, entries[0].Results[1].Status)
+	assert.False(entries[0].OK())
+
+	entries, _ = ReadHistory(fn, 2)
+	assert.Equal("web", entries[0].Target)
+	assert.Equal("cache", entries[1].Target)
+
+	assert.Equal("1 ok, 1 timeout", historyHosts(entries[0].Results))
+}
+
+func TestHistoryStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	failed := []CheckResult{{Check: "healthy", Error: "connection refused"}}
+	ok := []CommandResult{{Host: "db1", Status: StatusOK}}
+
+	assert.Equal(StatusOK, HistoryEntry{Results: ok}.Status())
+	assert.Equal(StatusRefused, HistoryEntry{Checks: failed}.Status())
+	assert.Equal(StatusRefused, HistoryEntry{Declined: true}.Status())
+	assert.Equal(StatusFailed, HistoryEntry{Results: ok, Checks: failed}.Status())
+}
@@ -1,23 +1,34 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"github.com/codegangsta/cli"
 	"github.com/fatih/color"
 	text "github.com/tonnerre/golang-text"
 	"log"
+	"math/rand"
 	"os"
 	"os/exec"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
+func init() {
+	RegisterItemType("host", ItemType{
+		New: func() Item { return &HostInfo{} },
+	})
+}
+
 // A HostInfo is a YAML file with information about a group of hosts
 type HostInfo struct {
 	RawType    string   `yaml:"type"`
 	RawSummary string   `yaml:"summary"`
+	RawAlias   string   `yaml:"alias"`
 	Types      HostType `yaml:"types"`
+	SeeAlso    []string `yaml:"see_also"`
 	id         string
 	path       string
 	repo       *Repo
@@ -35,10 +46,17 @@ type Category struct {
 
 // Host is a representation of one host
 type Host struct {
-	FQDN    string `yaml:"fqdn"`
-	Summary string `yaml:"summary"`
-	Kind    string `yaml:"kind"`
-	Primary bool   `yaml:"primary"`
+	FQDN    string      `yaml:"fqdn"`
+	Summary string      `yaml:"summary"`
+	Kind    string      `yaml:"kind"`
+	Primary bool        `yaml:"primary"`
+	SSH     SSHSettings `yaml:"ssh"`
+
+	// defaults are the SSH settings of the repository the host is defined in
+	defaults SSHSettings
+
+	// category is the name of the category the host is in
+	category string
 }
 
 func (h HostInfo) String() string {
@@ -50,39 +68,53 @@ func (h HostInfo) Execute(c *cli.Context) {
 	args := c.Args()
 	arglen := len(args)
 
+	if all, sync := tmuxMode(c); all {
+		categories := []string(args)
+		if arglen == 0 {
+			categories = h.Types.List()
+		}
+		h.openAll(categories, sync)
+		return
+	}
+
 	switch arglen {
 	case 0:
 		// No further arguments - we have selected a host entry but no type.
 		// Print the list of Types.
 		h.Types.PrintType()
+		printSeeAlso(h.repo.repos, h.SeeAlso)
 
 	case 1, 2:
-		t := args[0]
-		if cat, ok := h.Types[t]; ok {
-			if arglen == 1 {
-				// One argument, go to the primary of that category
-				cat.PrimaryHost().Execute("")
-			} else {
-				// Two arguments, go to specified host
-				x, err := strconv.Atoi(args[1])
-				if err != nil {
-					log.Fatal("Non-integer argument:", args[1])
-				}
-
-				host := cat.Hosts[x]
-				host.Execute("")
-			}
+		sel := ""
+		if arglen == 2 {
+			sel = args[1]
+		}
 
-		} else {
-			fmt.Println("No such type:", t)
-			fmt.Println(
-				fmt.Sprintf("Choices are: %s", strings.Join(h.Types.List(), ", ")),
-			)
+		host, err := h.SelectHost(args[0], sel)
+		if err != nil {
+			fmt.Println(err)
 			os.Exit(1)
 		}
+		host.Execute()
+
+	default:
+		fmt.Println("Too many arguments; give a category and optionally a host")
+		os.Exit(1)
 	}
 }
 
+// SelectHost returns a host of a category, see Category.Select
+func (h HostInfo) SelectHost(category, sel string) (*Host, error) {
+	cat, ok := h.Types[category]
+	if !ok {
+		return nil, fmt.Errorf(
+			"No such type: %s\nChoices are: %s",
+			category, strings.Join(h.Types.List(), ", "),
+		)
+	}
+	return cat.Select(sel)
+}
+
 // ID returns the ID of the item
 func (h HostInfo) ID() string {
 	return h.id
@@ -98,45 +130,54 @@ func (h HostInfo) Path() string {
 	return h.path
 }
 
+// Alias returns the alias of the item
+func (h HostInfo) Alias() string {
+	return h.RawAlias
+}
+
 // Summary returns the summary of the item
 func (h HostInfo) Summary() string {
 	return h.RawSummary
 }
 
+// References returns the `see_also` references of the item
+func (h HostInfo) References() []string {
+	return h.SeeAlso
+}
+
 // MakeCLI creates the CLI tree for a Host info
 func (h HostInfo) MakeCLI() []cli.Command {
 	sc := make([]cli.Command, 0, len(h.Types))
 	for _, key := range h.Types.List() {
+		key := key
 		cat := h.Types[key]
 		cc := cli.Command{ // cc = category command
 			Name:        key,
 			Usage:       cat.Summary,
 			HideHelp:    true,
 			Subcommands: make([]cli.Command, 0, len(cat.Hosts)),
+			Flags:       tmuxFlags,
 			Action: func(c *cli.Context) {
-				cat.PrimaryHost().Execute("")
+				// With --all, any arguments are more categories to open.
+				if all, sync := tmuxMode(c); all {
+					h.openAll(append([]string{key}, c.Args()...), sync)
+					return
+				}
+
+				// An index, kind or anything else that is not an FQDN
+				h.selectAndExecute(key, c.Args().First())
 			},
 		}
 
+		// The FQDNs are subcommands too, so that they can be tab completed.
 		for _, host := range cat.Hosts {
+			fqdn := host.FQDN
 			hc := cli.Command{ // hc = host command
-				Name:     host.FQDN,
+				Name:     fqdn,
 				Usage:    host.Summary,
 				HideHelp: true,
 				Action: func(c *cli.Context) {
-					var host *Host
-					args := c.Args()
-
-					if len(args) == 0 {
-						// No extra arguments - go to the primary host
-						host = cat.PrimaryHost()
-					} else {
-						// Arguments were defined - go to the fqdn specified
-						// TODO(thiderman): Error handling, integer index handling
-						host = cat.GetHost(args[0])
-					}
-
-					host.Execute("")
+					h.selectAndExecute(key, fqdn)
 				},
 			}
 			cc.Subcommands = append(cc.Subcommands, hc)
@@ -147,6 +188,51 @@ func (h HostInfo) MakeCLI() []cli.Command {
 	return sc
 }
 
+// selectAndExecute opens a ssh connection to a host of a category, exiting
+// with the valid choices if there is no such host
+func (h HostInfo) selectAndExecute(category, sel string) {
+	host, err := h.SelectHost(category, sel)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	host.Execute()
+}
+
+// Flags returns the flags of the command of the item
+func (h HostInfo) Flags() []cli.Flag {
+	return tmuxFlags
+}
+
+// openAll opens every host of the categories in a tmux window
+func (h HostInfo) openAll(categories []string, sync bool) {
+	var hosts []*Host
+	seen := make(map[string]bool)
+
+	for _, key := range categories {
+		cat, ok := h.Types[key]
+		if !ok {
+			fmt.Println("No such type:", key)
+			fmt.Println(
+				fmt.Sprintf("Choices are: %s", strings.Join(h.Types.List(), ", ")),
+			)
+			os.Exit(1)
+		}
+
+		for x := range cat.Hosts {
+			if host := &cat.Hosts[x]; !seen[host.FQDN] {
+				seen[host.FQDN] = true
+				hosts = append(hosts, host)
+			}
+		}
+	}
+
+	name := h.ID() + " " + strings.Join(categories, ",")
+	if err := OpenTmux(name, hosts, sync); err != nil {
+		log.Fatal(err)
+	}
+}
+
 // getHosts gets a string representation of all of the Types in the item
 func (h HostInfo) getHosts() (Types []string) {
 	for _, host := range h.Types.Hosts() {
@@ -179,6 +265,91 @@ func (c *Category) GetHost(fqdn string) (h *Host) {
 	return
 }
 
+// hostRand picks the hosts for `random`
+var hostRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// Select returns the primary host of the category for an empty `sel`, or the
+// host by index, FQDN, "kind:<kind>" or "random"
+func (c *Category) Select(sel string) (*Host, error) {
+	if len(c.Hosts) == 0 {
+		return nil, errors.New("The category has no hosts")
+	}
+
+	switch {
+	case sel == "":
+		return c.PrimaryHost(), nil
+
+	case sel == "random":
+		return &c.Hosts[hostRand.Intn(len(c.Hosts))], nil
+
+	case strings.HasPrefix(sel, "kind:"):
+		kind := strings.TrimPrefix(sel, "kind:")
+		var match *Host
+		for x := range c.Hosts {
+			host := &c.Hosts[x]
+			if host.Kind != kind {
+				continue
+			}
+			if host.Primary {
+				return host, nil
+			}
+			if match == nil {
+				match = host
+			}
+		}
+		if match != nil {
+			return match, nil
+		}
+	}
+
+	if x, err := strconv.Atoi(sel); err == nil {
+		if x >= 0 && x < len(c.Hosts) {
+			return &c.Hosts[x], nil
+		}
+	} else if host := c.GetHost(sel); host != nil {
+		return host, nil
+	}
+
+	return nil, fmt.Errorf("No such host: %s\nChoices are: %s", sel, strings.Join(c.choices(), ", "))
+}
+
+// SelectAll is Select for places that can use more than one host. "all"
+// selects every host of the category.
+func (c *Category) SelectAll(sel string) ([]*Host, error) {
+	if sel != "all" || len(c.Hosts) == 0 {
+		host, err := c.Select(sel)
+		if err != nil {
+			return nil, err
+		}
+		return []*Host{host}, nil
+	}
+
+	hosts := make([]*Host, len(c.Hosts))
+	for x := range c.Hosts {
+		hosts[x] = &c.Hosts[x]
+	}
+	return hosts, nil
+}
+
+// choices lists what Select accepts for the category
+func (c *Category) choices() []string {
+	choices := []string{fmt.Sprintf("0-%d", len(c.Hosts)-1)}
+
+	seen := make(map[string]bool)
+	for _, host := range c.Hosts {
+		if host.Kind != "" && !seen[host.Kind] {
+			seen[host.Kind] = true
+			choices = append(choices, "kind:"+host.Kind)
+		}
+	}
+
+	choices = append(choices, "random")
+	for _, host := range c.Hosts {
+		choices = append(choices, host.FQDN)
+	}
+	return choices
+}
+
 // List returns a list of the types in the category map
 func (h HostType) List() (keys []string) {
 	for key := range h {
@@ -260,7 +431,8 @@ func (h *Host) hasHost() bool {
 func (h *Host) Execute(extra ...string) {
 	ssh, _ := exec.LookPath("ssh")
 
-	args := append([]string{ssh, h.FQDN, "-A", "-t"}, extra...)
+	args := h.Command(extra...)
+	args[0] = ssh
 
 	cmd := exec.Cmd{
 		Path:   ssh,
@@ -275,3 +447,36 @@ func (h *Host) Execute(extra ...string) {
 		log.Fatal("ssh command failed: ", err)
 	}
 }
+
+// Command returns the ssh command line for the host
+func (h *Host) Command(extra ...string) []string {
+	args := append([]string{"ssh"}, h.Settings().Args()...)
+	args = append(args, h.FQDN, "-A", "-t")
+	return append(args, extra...)
+}
+
+// Settings returns the SSH settings of the host, which are the defaults of
+// its repository with the settings of the host itself on top
+func (h *Host) Settings() SSHSettings {
+	return h.defaults.Merge(h.SSH)
+}
+
+// Category returns the name of the category the host is in
+func (h *Host) Category() string {
+	return h.category
+}
+
+// bind sets the fields of the item that are not read from its file
+func (h *HostInfo) bind(r *Repo, p string) {
+	h.id = asKey(p)
+	h.path = p
+	h.repo = r
+
+	// The categories are copies, but their hosts are not.
+	for name, cat := range h.Types {
+		for x := range cat.Hosts {
+			cat.Hosts[x].defaults = r.defaults.SSH
+			cat.Hosts[x].category = name
+		}
+	}
+}
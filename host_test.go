@@ -2,7 +2,7 @@ package main
 
 import (
 	"github.com/stretchr/testify/assert"
-	"gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
 	"io/ioutil"
 	"log"
 	"testing"
@@ -43,7 +43,7 @@ func ExampleHostType() {
 
 	conf := &Config{}
 	yaml.Unmarshal(data, conf)
-	repos := LoadRepos(conf)
+	repos, _ := LoadRepos(conf)
 
 	app := BuildCLI(repos, conf)
 	app.Run([]string{"sagacity", "printout", "hosts", "db"})
@@ -73,3 +73,53 @@ func ExampleHostType() {
 	//   WAL archive storage machines
 	//   [33m[[0m[93;1m0[0m[33m][0m [34;1mdb7.cluster3.company.net[0m
 }
+
+func TestCategorySelect(t *testing.T) {
+	assert := assert.New(t)
+	cat := testHostInfo().Types["ro"]
+
+	for sel, fqdn := range map[string]string{
+		"":                         "db4.cluster3.company.net",
+		"0":                        "db2.cluster3.company.net",
+		"2":                        "db6.cluster3.company.net",
+		"db5.cluster3.company.net": "db5.cluster3.company.net",
+		"kind:longquery":           "db4.cluster3.company.net",
+	} {
+		host, err := cat.Select(sel)
+		assert.Nil(err, sel)
+		assert.Equal(fqdn, host.FQDN, sel)
+	}
+
+	host, err := cat.Select("random")
+	assert.Nil(err)
+	assert.Contains(cat.Hosts, *host)
+}
+
+func TestCategorySelectListsChoices(t *testing.T) {
+	assert := assert.New(t)
+	h := testHostInfo()
+
+	for _, sel := range []string{"4", "-1", "kind:batch", "db9.cluster3.company.net"} {
+		_, err := h.SelectHost("ro", sel)
+		assert.EqualError(err, "No such host: "+sel+"\nChoices are: 0-3, kind:longquery, random, "+
+			"db2.cluster3.company.net, db5.cluster3.company.net, db6.cluster3.company.net, db4.cluster3.company.net")
+	}
+
+	_, err := h.SelectHost("rw", "")
+	assert.EqualError(err, "No such type: rw\nChoices are: master, ro, standby, task, wal")
+
+	_, err = (&Category{}).Select("")
+	assert.NotNil(err)
+}
+
+func TestGetHostSelectsHosts(t *testing.T) {
+	assert := assert.New(t)
+	r := NewRepo("test/repos/host_tests/printout")
+
+	host, err := r.GetHost("db standby kind:disaster")
+	assert.Nil(err)
+	assert.Equal("db1.cluster3.company.net", host.FQDN)
+
+	_, err = r.GetHost("db standby 7")
+	assert.Contains(err.Error(), "printout hosts db standby: No such host: 7")
+}
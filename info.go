@@ -4,56 +4,21 @@ import (
 	"fmt"
 	"github.com/codegangsta/cli"
 	"github.com/tonnerre/golang-text"
-	"gopkg.in/yaml.v2"
-	"io/ioutil"
-	"log"
 )
 
-// An Item is a representation of the YAML files in the repositories
-type Item interface {
-	Execute(c *cli.Context)
-	String() string
-	MakeCLI() []cli.Command
-	ID() string
-	Type() string
-	Path() string
-	Summary() string
-}
-
-// LoadItem loads an Info object from a file path
-func LoadItem(r *Repo, p string) (Item, error) {
-	data, err := ioutil.ReadFile(p)
-	if err != nil {
-		log.Fatal("Reading file failed: ", p)
-	}
-
-	// TODO(thiderman): Avoid the double unmarshal.
-	// Is there a way we can know some of the data in the stream before the unmarshal?
-	// Probably not?
-	i := &Info{id: asKey(p), path: p, repo: r}
-	yaml.Unmarshal(data, &i)
-
-	switch i.Type() {
-	case "command":
-		c := &Command{id: asKey(p), path: p, repo: r}
-		yaml.Unmarshal(data, &c)
-		return c, nil
-
-	case "host":
-		h := &HostInfo{id: asKey(p), path: p, repo: r}
-		yaml.Unmarshal(data, &h)
-		return h, nil
-	}
-
-	yaml.Unmarshal(data, &i)
-	return i, nil
+func init() {
+	RegisterItemType("info", ItemType{
+		New: func() Item { return &Info{} },
+	})
 }
 
 // Info is the main storage for information. All yaml files map to this.
 type Info struct {
-	RawType    string `yaml:"type"`
-	RawSummary string `yaml:"summary"`
-	Body       string `yaml:"body"`
+	RawType    string   `yaml:"type"`
+	RawSummary string   `yaml:"summary"`
+	RawAlias   string   `yaml:"alias"`
+	Body       string   `yaml:"body"`
+	SeeAlso    []string `yaml:"see_also"`
 	id         string
 	path       string
 	repo       *Repo
@@ -63,10 +28,12 @@ func (i Info) String() string {
 	return fmt.Sprintf("I: %s", i.ID())
 }
 
-// Execute will print the body
+// Execute will print the body, with any vars and links rendered
 func (i Info) Execute(c *cli.Context) {
-	out := text.Wrap(i.Body, 80)
+	body := expandVars(i.Body, i.repo.defaults.Vars)
+	out := text.Wrap(renderLinks(i.repo.repos, body), 80)
 	fmt.Println(out)
+	printSeeAlso(i.repo.repos, i.SeeAlso)
 }
 
 // MakeCLI makes a dummy CLI - Info items have no subcommands
@@ -89,7 +56,25 @@ func (i Info) Path() string {
 	return i.path
 }
 
+// Alias returns the alias of the item
+func (i Info) Alias() string {
+	return i.RawAlias
+}
+
 // Summary returns the summary of the item
 func (i Info) Summary() string {
 	return i.RawSummary
 }
+
+// References returns the `see_also` references and inline links of the item
+func (i Info) References() []string {
+	refs := append([]string{}, i.SeeAlso...)
+	return append(refs, parseLinks(i.Body)...)
+}
+
+// bind sets the fields of the item that are not read from its file
+func (i *Info) bind(r *Repo, p string) {
+	i.id = asKey(p)
+	i.path = p
+	i.repo = r
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"github.com/codegangsta/cli"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// An Item is a representation of the YAML files in the repositories
+type Item interface {
+	Execute(c *cli.Context)
+	String() string
+	MakeCLI() []cli.Command
+	ID() string
+	Type() string
+	Path() string
+	Summary() string
+	Alias() string
+	References() []string
+
+	// bind sets the fields of the item that are not read from its file
+	bind(r *Repo, p string)
+}
+
+// itemFlagger is implemented by items that take flags of their own
+type itemFlagger interface {
+	Flags() []cli.Flag
+}
+
+// An ItemType tells LoadItem how to create the items of one `type`
+type ItemType struct {
+	// New returns an empty item to decode the file into
+	New func() Item
+
+	// Decode fills the item with the contents of its file. If it is not set,
+	// the node is decoded straight into the item.
+	Decode func(item Item, node *yaml.Node) error
+}
+
+// defaultItemType is the type of items that do not specify one
+const defaultItemType = "info"
+
+var (
+	itemTypes   = make(map[string]ItemType)
+	itemTypesMu sync.RWMutex
+)
+
+// RegisterItemType makes files with `type: <name>` load as the given ItemType,
+// and registers the item with gob so that it can be cached
+func RegisterItemType(name string, t ItemType) {
+	itemTypesMu.Lock()
+	defer itemTypesMu.Unlock()
+
+	if _, ok := itemTypes[name]; ok {
+		panic(fmt.Sprintf("item type %q registered twice", name))
+	}
+
+	itemTypes[name] = t
+	gob.Register(t.New())
+}
+
+// ItemTypes returns a sorted list of the names of the registered item types
+func ItemTypes() []string {
+	itemTypesMu.RLock()
+	defer itemTypesMu.RUnlock()
+
+	names := make([]string, 0, len(itemTypes))
+	for name := range itemTypes {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// LoadItem loads an Item from a file path, as the ItemType of its `type`, an Info
+// item without one, or a plugin item for types that are not registered
+func LoadItem(r *Repo, p string) (Item, error) {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %s", p, err)
+	}
+
+	// Empty files have no content at all.
+	var node *yaml.Node
+	if len(doc.Content) != 0 {
+		node = doc.Content[0]
+		if node.Kind != yaml.MappingNode {
+			return nil, fmt.Errorf("%s: the file is not a YAML mapping", p)
+		}
+	}
+
+	name := nodeType(node)
+
+	itemTypesMu.RLock()
+	t, ok := itemTypes[name]
+	itemTypesMu.RUnlock()
+
+	if !ok {
+		if command, ok := findPlugin(r, name); ok {
+			return loadPlugin(r, p, name, command, node)
+		}
+
+		return nil, fmt.Errorf(
+			"%s: unknown item type %q; known types are %s",
+			p, name, strings.Join(ItemTypes(), ", "),
+		)
+	}
+
+	item := t.New()
+	if node != nil {
+		decode := t.Decode
+		if decode == nil {
+			decode = func(item Item, node *yaml.Node) error {
+				return node.Decode(item)
+			}
+		}
+
+		if err := decode(item, node); err != nil {
+			return nil, fmt.Errorf("%s: %s", p, err)
+		}
+	}
+
+	item.bind(r, p)
+	return item, nil
+}
+
+// nodeType returns the value of the `type` field of a mapping node
+func nodeType(node *yaml.Node) string {
+	if node == nil {
+		return defaultItemType
+	}
+
+	// The content of a mapping node alternates between keys and values.
+	for x := 0; x+1 < len(node.Content); x += 2 {
+		if node.Content[x].Value == "type" && node.Content[x+1].Value != "" {
+			return node.Content[x+1].Value
+		}
+	}
+	return defaultItemType
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+	"testing"
+)
+
+// testNote is an item type that is only registered by the tests
+type testNote struct {
+	Info    `yaml:",inline"`
+	Extra   string `yaml:"extra"`
+	decoded bool
+}
+
+func init() {
+	RegisterItemType("note", ItemType{
+		New: func() Item { return &testNote{} },
+		Decode: func(item Item, node *yaml.Node) error {
+			note := item.(*testNote)
+			note.decoded = true
+			return node.Decode(note)
+		},
+	})
+}
+
+func TestLoadItemUsesRegisteredTypes(t *testing.T) {
+	assert := assert.New(t)
+	r := &Repo{}
+
+	i, err := LoadItem(r, "test/repos/key_tests/one/topic/note.yaml")
+	assert.Nil(err)
+	assert.IsType(&Info{}, i)
+
+	h, err := LoadItem(r, "test/repos/host_tests/printout/hosts/db.yaml")
+	assert.Nil(err)
+	assert.IsType(&HostInfo{}, h)
+	assert.Equal("db", h.ID())
+	assert.Equal("pg", h.Alias())
+}
+
+func TestLoadItemUsesCustomDecoders(t *testing.T) {
+	assert := assert.New(t)
+	r := &Repo{}
+
+	item, err := LoadItem(r, "test/items/note.yaml")
+
+	assert.Nil(err)
+	note := item.(*testNote)
+	assert.True(note.decoded)
+	assert.Equal("registered", note.Extra)
+	assert.Equal("A custom type", note.Summary())
+	assert.Equal("note", note.ID())
+	assert.Equal(r, note.repo)
+}
+
+func TestLoadItemDefaultsToInfo(t *testing.T) {
+	assert := assert.New(t)
+
+	item, err := LoadItem(&Repo{}, "test/items/untyped.yaml")
+
+	assert.Nil(err)
+	assert.IsType(&Info{}, item)
+	assert.Equal("Defaults to info", item.(*Info).Body)
+
+	item, err = LoadItem(&Repo{}, "test/data/_repo.yaml")
+	assert.Nil(err)
+	assert.IsType(&Info{}, item)
+}
+
+func TestLoadItemFailsOnUnknownTypes(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := LoadItem(&Repo{}, "test/items/unknown.yaml")
+
+	assert.NotNil(err)
+	assert.Contains(err.Error(), `unknown item type "sql"; known types are command, host, info, note`)
+}
+
+func TestLoadItemFailsOnNonMappings(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := LoadItem(&Repo{}, "test/items/list.yaml")
+
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "not a YAML mapping")
+}
+
+func TestRegisterItemTypePanicsOnDuplicates(t *testing.T) {
+	assert.Panics(t, func() {
+		RegisterItemType("info", ItemType{New: func() Item { return &Info{} }})
+	})
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// A LintIssue is a problem found in an item of a repository
+type LintIssue struct {
+	Path    string
+	Message string
+}
+
+func (l LintIssue) String() string {
+	return fmt.Sprintf("%s: %s", l.Path, l.Message)
+}
+
+// LintRepos checks all the items in the repositories for problems
+func LintRepos(repos map[string]*Repo) (issues []LintIssue) {
+	for _, key := range repoKeys(repos) {
+		issues = append(issues, lintSchedules(repos[key])...)
+		repos[key].Walk(func(ref string, item Item) {
+			for _, r := range item.References() {
+				if _, err := ResolveRef(repos, r); err != nil {
+					issues = append(issues, LintIssue{
+						Path:    item.Path(),
+						Message: fmt.Sprintf("broken reference %q: %s", r, err),
+					})
+				}
+			}
+
+			switch i := item.(type) {
+			case *Command:
+				issues = append(issues, lintHosts(i.Path(), i.repo, i.Hosts)...)
+				if _, err := riskLevel(i.Risk()); err != nil {
+					issues = append(issues, LintIssue{Path: i.Path(), Message: err.Error()})
+				}
+				if err := validateSchedule(i.Windows, i.Freezes); err != nil {
+					issues = append(issues, LintIssue{Path: i.Path(), Message: err.Error()})
+				}
+				for _, rule := range i.Expect {
+					if err := rule.Validate(); err != nil {
+						issues = append(issues, LintIssue{
+							Path:    i.Path(),
+							Message: fmt.Sprintf("invalid expect rule: %s", err),
+						})
+					}
+				}
+				for _, check := range append(i.Preconditions, i.Postconditions...) {
+					if err := i.validateCheck(check); err != nil {
+						issues = append(issues, LintIssue{
+							Path:    i.Path(),
+							Message: fmt.Sprintf("invalid check %q: %s", check, err),
+						})
+					}
+				}
+			case *Tunnel:
+				issues = append(issues, lintTunnel(i)...)
+			case *Transfer:
+				issues = append(issues, lintHosts(i.Path(), i.repo, i.Hosts)...)
+				if _, err := riskLevel(i.Risk()); err != nil {
+					issues = append(issues, LintIssue{Path: i.Path(), Message: err.Error()})
+				}
+				if err := validateSchedule(i.Windows, i.Freezes); err != nil {
+					issues = append(issues, LintIssue{Path: i.Path(), Message: err.Error()})
+				}
+			}
+		})
+	}
+
+	return
+}
+
+// lintHosts checks that the hosts of every target of an item can be found
+func lintHosts(path string, r *Repo, hosts map[string]string) (issues []LintIssue) {
+	for _, target := range commandHostKey(hosts) {
+		def := hosts[target]
+		if _, err := r.GetHosts(def); err != nil {
+			issues = append(issues, LintIssue{
+				Path:    path,
+				Message: fmt.Sprintf("unresolvable hosts %q for target %q: %s", def, target, err),
+			})
+		}
+	}
+	return
+}
+
+// lintTunnel checks that the `via` host and the targets of the forwards of a
+// tunnel can be found, and that the tunnel can be started with them
+func lintTunnel(t *Tunnel) []LintIssue {
+	hosts := make(map[string]string)
+	if t.Via != "" {
+		hosts["via"] = t.Via
+	}
+	for _, f := range t.Forwards {
+		if f.Local != 0 {
+			hosts[fmt.Sprintf("local %d", f.Local)] = f.Target
+		}
+	}
+
+	issues := lintHosts(t.Path(), t.repo, hosts)
+	if len(issues) == 0 {
+		if _, _, err := t.sshArgs(); err != nil {
+			issues = append(issues, LintIssue{Path: t.Path(), Message: err.Error()})
+		}
+	}
+	return issues
+}
+
+// lintSchedules checks the maintenance windows and freezes of a repository
+// and its subrepos
+func lintSchedules(r *Repo) (issues []LintIssue) {
+	if err := validateSchedule(r.Windows, r.Freezes); err != nil {
+		issues = append(issues, LintIssue{
+			Path:    filepath.Join(r.root, "_repo.yaml"),
+			Message: err.Error(),
+		})
+	}
+	for _, key := range repoKeys(r.Subrepos) {
+		issues = append(issues, lintSchedules(r.Subrepos[key])...)
+	}
+	return issues
+}
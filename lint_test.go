@@ -0,0 +1,57 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestLintReposReportsBrokenReferences(t *testing.T) {
+	assert := assert.New(t)
+	repos := testRefRepos()
+
+	issues := LintRepos(repos)
+
+	assert.Equal(2, len(issues))
+	assert.Contains(issues[0].Message, `"wiki nowhere"`)
+	assert.Contains(issues[1].Message, `"wiki guides missing"`)
+}
+
+func TestLintReposReportsUnresolvableHosts(t *testing.T) {
+	assert := assert.New(t)
+	repos := testParentRepos()
+
+	issues := LintRepos(repos)
+
+	assert.Equal(3, len(issues))
+	for _, issue := range issues {
+		assert.True(strings.HasSuffix(issue.Path, "shop/ops/broken.yaml"))
+	}
+	assert.Contains(issues[0].Message, `unresolvable hosts "db replica" for target "local"`)
+	assert.Contains(issues[1].Message, `unresolvable hosts "infra:hosts queue primary" for target "queue"`)
+	assert.Contains(issues[2].Message, `"nowhere:hosts db master" for target "remote": No such repository: nowhere`)
+}
+
+func TestLintReposReportsBrokenTunnels(t *testing.T) {
+	assert := assert.New(t)
+	repos := testParentRepos()
+	ops := repos["shop"].Subrepos["ops"]
+
+	broken := &Tunnel{
+		Via:      "bastion primry",
+		Forwards: []Forward{{Local: 5433, Target: "db mastr", Port: 5432}},
+	}
+	broken.bind(ops, "test/repos/parent_tests/shop/ops/broken-tunnel.yaml")
+	ops.Items["broken-tunnel"] = broken
+
+	var messages []string
+	for _, issue := range LintRepos(repos) {
+		if strings.HasSuffix(issue.Path, "broken-tunnel.yaml") {
+			messages = append(messages, issue.Message)
+		}
+	}
+
+	assert.Equal(2, len(messages))
+	assert.Contains(messages[0], `unresolvable hosts "db mastr" for target "local 5433"`)
+	assert.Contains(messages[1], `unresolvable hosts "bastion primry" for target "via"`)
+}
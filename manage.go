@@ -0,0 +1,488 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fatih/color"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// UpdateStatus is the outcome of updating a single repository
+type UpdateStatus string
+
+// The possible outcomes of updating a repository
+const (
+	Updated    UpdateStatus = "updated"
+	UpToDate   UpdateStatus = "up-to-date"
+	Skipped    UpdateStatus = "skipped"
+	Conflict   UpdateStatus = "conflict"
+	Unverified UpdateStatus = "unverified"
+	Failed     UpdateStatus = "error"
+)
+
+// UpdateResult is the result of updating a single repository
+type UpdateResult struct {
+	Key    string
+	Status UpdateStatus
+	Detail string
+}
+
+// UpdateOptions controls how UpdateRepos updates the repositories
+type UpdateOptions struct {
+	// Jobs is the maximum number of repositories updated at the same time
+	Jobs int
+	// AllowDirty makes repositories with local modifications update anyway
+	AllowDirty bool
+}
+
+// UpdateRepos pulls all the configured repositories concurrently, returning the
+// results in the order of the configuration
+func UpdateRepos(config *Config, repos map[string]*Repo, opts UpdateOptions) []UpdateResult {
+	if opts.Jobs < 1 {
+		opts.Jobs = 1
+	}
+
+	results := make([]UpdateResult, len(config.Repositories))
+	sem := make(chan bool, opts.Jobs)
+	done := make(chan bool)
+
+	for x, rc := range config.Repositories {
+		go func(x int, rc RepoConfig) {
+			sem <- true
+			results[x] = updateRepo(rc, opts)
+			results[x].Key = configuredKey(rc, repos)
+			<-sem
+			done <- true
+		}(x, rc)
+	}
+
+	for range config.Repositories {
+		<-done
+	}
+
+	return results
+}
+
+// PrintUpdateResults prints a summary of UpdateRepos, returning false if any
+// of the updates failed
+func PrintUpdateResults(results []UpdateResult) bool {
+	green := color.New(color.FgGreen, color.Bold).SprintfFunc()
+	yellow := color.New(color.FgYellow, color.Bold).SprintfFunc()
+	red := color.New(color.FgRed, color.Bold).SprintfFunc()
+
+	ok := true
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, res := range results {
+		status := string(res.Status)
+		switch res.Status {
+		case Updated, UpToDate:
+			status = green(status)
+		case Skipped:
+			status = yellow(status)
+		default:
+			status = red(status)
+			ok = false
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\n", res.Key, status, res.Detail)
+	}
+
+	w.Flush()
+	return ok
+}
+
+// updateRepo fetches and merges the branch a repository is meant to follow,
+// aborting merges that conflict
+func updateRepo(rc RepoConfig, opts UpdateOptions) UpdateResult {
+	switch rc.Type {
+	case LocalRepo:
+		return UpdateResult{Status: Skipped, Detail: "local directory"}
+	case ArchiveRepo:
+		return updateArchiveRepo(rc)
+	}
+
+	st, err := GitStatus(rc.Path)
+	if err != nil {
+		return UpdateResult{Status: Failed, Detail: err.Error()}
+	}
+
+	if st.Dirty && !opts.AllowDirty {
+		return UpdateResult{Status: Skipped, Detail: "local modifications"}
+	}
+
+	if rc.Ref != "" {
+		return updatePinnedRepo(rc)
+	}
+
+	remote, branch, err := trackedBranch(rc)
+	if err != nil {
+		return UpdateResult{Status: Failed, Detail: err.Error()}
+	}
+
+	before, err := gitOutput(rc.Path, "rev-parse", "HEAD")
+	if err != nil {
+		return UpdateResult{Status: Failed, Detail: err.Error()}
+	}
+
+	if _, err := gitOutput(rc.Path, "fetch", "--quiet", remote, branch); err != nil {
+		return UpdateResult{Status: Failed, Detail: err.Error()}
+	}
+
+	// Switch to the configured branch if something else is checked out
+	current, _ := gitOutput(rc.Path, "rev-parse", "--abbrev-ref", "HEAD")
+	if current != branch {
+		if _, err := gitOutput(rc.Path, "checkout", "--quiet", branch); err != nil {
+			return UpdateResult{Status: Failed, Detail: err.Error()}
+		}
+	}
+
+	// Merge commits made here would not be signed, so repositories with a
+	// signature policy only fast forward to the verified commit.
+	merge := []string{"merge", "--quiet", "--no-edit", "FETCH_HEAD"}
+	if rc.Verify != nil {
+		if err := rc.Verify.VerifyCommit(rc.Path, "FETCH_HEAD"); err != nil {
+			return UpdateResult{Status: Unverified, Detail: err.Error()}
+		}
+		merge = append(merge, "--ff-only")
+	}
+
+	if _, err := gitOutput(rc.Path, merge...); err != nil {
+		unmerged, _ := gitOutput(rc.Path, "diff", "--name-only", "--diff-filter=U")
+		if unmerged == "" {
+			return UpdateResult{Status: Failed, Detail: err.Error()}
+		}
+
+		gitOutput(rc.Path, "merge", "--abort")
+		return UpdateResult{
+			Status: Conflict,
+			Detail: "merge aborted, conflicts in " + strings.Replace(unmerged, "\n", ", ", -1),
+		}
+	}
+
+	after, _ := gitOutput(rc.Path, "rev-parse", "HEAD")
+	if before == after && current == branch {
+		return UpdateResult{Status: UpToDate}
+	}
+
+	return UpdateResult{
+		Status: Updated,
+		Detail: fmt.Sprintf("%s/%s at %.7s", remote, branch, after),
+	}
+}
+
+// updatePinnedRepo checks out the ref that a repository is pinned to. Branches
+// are looked up on the remote first, so that a pinned branch is followed.
+func updatePinnedRepo(rc RepoConfig) UpdateResult {
+	before, err := gitOutput(rc.Path, "rev-parse", "HEAD")
+	if err != nil {
+		return UpdateResult{Status: Failed, Detail: err.Error()}
+	}
+
+	if _, err := gitOutput(rc.Path, "fetch", "--quiet", "--tags", "origin"); err != nil {
+		return UpdateResult{Status: Failed, Detail: err.Error()}
+	}
+
+	commit, err := resolveRef(rc.Path, rc.Ref)
+	if err != nil {
+		return UpdateResult{Status: Failed, Detail: err.Error()}
+	}
+
+	if rc.Verify != nil {
+		if err := rc.Verify.VerifyCommit(rc.Path, commit); err != nil {
+			return UpdateResult{Status: Unverified, Detail: err.Error()}
+		}
+	}
+
+	if _, err := gitOutput(rc.Path, "checkout", "--quiet", "--detach", commit); err != nil {
+		return UpdateResult{Status: Failed, Detail: err.Error()}
+	}
+
+	if before == commit {
+		return UpdateResult{Status: UpToDate, Detail: "pinned to " + rc.Ref}
+	}
+
+	return UpdateResult{
+		Status: Updated,
+		Detail: fmt.Sprintf("pinned to %s at %.7s", rc.Ref, commit),
+	}
+}
+
+// resolveRef returns the commit that a branch, tag or commit ref points to
+func resolveRef(path, ref string) (string, error) {
+	for _, candidate := range []string{"origin/" + ref, ref} {
+		commit, err := gitOutput(path, "rev-parse", "--verify", "--quiet", candidate+"^{commit}")
+		if err == nil {
+			return commit, nil
+		}
+	}
+	return "", fmt.Errorf("No such ref: %s", ref)
+}
+
+// PinRepo pins a repository to a ref, or unpins it if the ref is empty
+func PinRepo(config *Config, repos map[string]*Repo, key, ref string) error {
+	x, err := config.findRepo(key, repos)
+	if err != nil {
+		return err
+	}
+
+	if config.Repositories[x].Type != GitRepo {
+		return fmt.Errorf("Only git repositories can be pinned: %s", key)
+	}
+
+	return config.SetRepoRef(x, ref)
+}
+
+// trackedBranch returns the remote and branch that a repository follows
+func trackedBranch(rc RepoConfig) (remote, branch string, err error) {
+	remote = "origin"
+
+	if rc.Branch != "" {
+		return remote, rc.Branch, nil
+	}
+
+	branch, err = gitOutput(rc.Path, "rev-parse", "--abbrev-ref", "HEAD")
+	if err != nil {
+		return
+	}
+
+	// Follow the upstream of the checked out branch, unless it is another
+	// local branch. Otherwise, pull the checked out branch from origin.
+	if branch != "HEAD" {
+		upstream, _ := gitOutput(rc.Path, "config", "branch."+branch+".remote")
+		merge, _ := gitOutput(rc.Path, "config", "branch."+branch+".merge")
+		if upstream != "" && upstream != "." && merge != "" {
+			return upstream, strings.TrimPrefix(merge, "refs/heads/"), nil
+		}
+		return remote, branch, nil
+	}
+
+	// Nothing is checked out, which is the case for repositories that have
+	// been unpinned. Go back to the default branch of the remote.
+	head, err := gitOutput(rc.Path, "rev-parse", "--abbrev-ref", "origin/HEAD")
+	if err != nil {
+		return "", "", errors.New("Detached HEAD and no default branch on origin; set a branch in the config")
+	}
+	return remote, strings.TrimPrefix(head, "origin/"), nil
+}
+
+// RepoInfo describes a configured repository and the state of its clone
+type RepoInfo struct {
+	Config  RepoConfig
+	Repo    *Repo // nil if the repository is not loaded
+	Key     string
+	Remote  string
+	Branch  string
+	Ref     string // the tag or commit that is checked out
+	Items   int
+	Updated time.Time
+}
+
+// InspectRepo gathers information about a configured repository, leaving out
+// what git cannot tell
+func InspectRepo(rc RepoConfig, repos map[string]*Repo) RepoInfo {
+	var err error
+	info := RepoInfo{Config: rc, Key: configuredKey(rc, repos)}
+
+	if r, ok := repos[info.Key]; ok && r.root == absPath(rc.Path) {
+		info.Repo = r
+		r.Walk(func(string, Item) {
+			info.Items++
+		})
+	}
+
+	switch rc.Type {
+	case LocalRepo:
+		return info
+	case ArchiveRepo:
+		info.Remote = rc.Source
+		info.Updated = archiveUpdated(rc)
+		return info
+	}
+
+	info.Remote, _ = gitOutput(rc.Path, "config", "--get", "remote.origin.url")
+	info.Branch, _ = gitOutput(rc.Path, "rev-parse", "--abbrev-ref", "HEAD")
+
+	// Show the tag that is checked out if there is one, or the commit.
+	info.Ref, err = gitOutput(rc.Path, "describe", "--tags", "--exact-match")
+	if err != nil {
+		info.Ref, _ = gitOutput(rc.Path, "rev-parse", "--short", "HEAD")
+	}
+
+	// FETCH_HEAD is written on every pull, making it a good marker of when
+	// the repository was last updated.
+	if st, err := os.Stat(filepath.Join(rc.Path, ".git", "FETCH_HEAD")); err == nil {
+		info.Updated = st.ModTime()
+	}
+
+	return info
+}
+
+// ListRepos prints a table of the configured repositories
+func ListRepos(config *Config, repos map[string]*Repo) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tPATH\tREMOTE\tBRANCH\tPINNED\tREF\tITEMS\tUPDATED")
+
+	for _, rc := range config.Repositories {
+		info := InspectRepo(rc, repos)
+
+		items := "-"
+		if info.Repo != nil {
+			items = strconv.Itoa(info.Items)
+		}
+
+		updated := "never"
+		if !info.Updated.IsZero() {
+			updated = info.Updated.Format("2006-01-02 15:04")
+		}
+
+		fmt.Fprintf(
+			w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			info.Key, rc.Path, orDash(info.Remote), orDash(info.Branch),
+			orDash(rc.Ref), orDash(info.Ref), items, updated,
+		)
+	}
+
+	w.Flush()
+}
+
+// RepoStatus is the state of the working tree of a repository, as of the last
+// fetch
+type RepoStatus struct {
+	Dirty  bool
+	Ahead  int
+	Behind int
+}
+
+// GitStatus returns the status of the git repository on a path
+func GitStatus(path string) (st RepoStatus, err error) {
+	out, err := gitOutput(path, "status", "--porcelain")
+	if err != nil {
+		return
+	}
+	st.Dirty = out != ""
+
+	// Repositories without an upstream are neither ahead nor behind.
+	out, err = gitOutput(path, "rev-list", "--left-right", "--count", "@{upstream}...HEAD")
+	if err != nil {
+		return st, nil
+	}
+
+	fmt.Sscanf(out, "%d %d", &st.Behind, &st.Ahead)
+	return
+}
+
+// PrintRepoStatus prints the status of all the configured repositories
+func PrintRepoStatus(config *Config, repos map[string]*Repo) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tSTATUS\tAHEAD\tBEHIND")
+
+	for _, rc := range config.Repositories {
+		key := configuredKey(rc, repos)
+
+		switch rc.Type {
+		case LocalRepo:
+			fmt.Fprintf(w, "%s\tlocal directory\t-\t-\n", key)
+			continue
+		case ArchiveRepo:
+			fmt.Fprintf(w, "%s\tread-only archive\t-\t-\n", key)
+			continue
+		}
+
+		st, err := GitStatus(rc.Path)
+		if err != nil {
+			fmt.Fprintf(w, "%s\terror: %s\t-\t-\n", key, err)
+			continue
+		}
+
+		status := "clean"
+		if st.Dirty {
+			status = "dirty"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\n", key, status, st.Ahead, st.Behind)
+	}
+
+	w.Flush()
+}
+
+// RemoveRepo removes a repository from the configuration
+//
+// With `purge`, clones in the repository root are removed from disk as well.
+func RemoveRepo(config *Config, repos map[string]*Repo, key string, purge bool) error {
+	x, err := config.findRepo(key, repos)
+	if err != nil {
+		return err
+	}
+
+	rc := config.Repositories[x]
+	if purge {
+		if rc.Type == LocalRepo {
+			return fmt.Errorf("%s is a local repository, which sagacity does not delete", rc.Path)
+		}
+
+		rel, err := filepath.Rel(absPath(config.RepoRoot), absPath(rc.Path))
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			return fmt.Errorf("%s is not in %s, so sagacity does not delete it", rc.Path, config.RepoRoot)
+		}
+	}
+
+	if err := config.RemoveRepo(x); err != nil {
+		return err
+	}
+
+	if purge {
+		if err := os.RemoveAll(rc.Path); err != nil {
+			return err
+		}
+		log.Printf("Deleted %s", rc.Path)
+	}
+
+	log.Printf("Removed %s", key)
+	return nil
+}
+
+// SetRepoPath changes the path of a configured repository
+func SetRepoPath(config *Config, repos map[string]*Repo, key, path string) error {
+	x, err := config.findRepo(key, repos)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(filepath.Join(path, "_repo.yaml")); os.IsNotExist(err) {
+		return fmt.Errorf("No _repo.yaml found in %s", path)
+	}
+
+	return config.SetRepoPath(x, absPath(path))
+}
+
+// findRepo returns the index of a repository in the configuration, by key or path
+func (c *Config) findRepo(key string, repos map[string]*Repo) (int, error) {
+	for x, rc := range c.Repositories {
+		if configuredKey(rc, repos) == key || absPath(rc.Path) == absPath(key) {
+			return x, nil
+		}
+	}
+	return -1, fmt.Errorf("No such repository: %s", key)
+}
+
+// configuredKey returns the key of a configured repository, loaded or not
+func configuredKey(rc RepoConfig, repos map[string]*Repo) string {
+	for key, r := range repos {
+		if r.root == absPath(rc.Path) {
+			return key
+		}
+	}
+	return rc.LoadedKey()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// testGit runs a git command in a test repository, failing the test on errors
+func testGit(t *testing.T, dir string, args ...string) {
+	args = append([]string{"-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git %v failed: %s\n%s", args, err, out)
+	}
+}
+
+// testClone creates an upstream repository with one commit and a clone of it,
+// returning the paths of both
+func testClone(t *testing.T) (string, string, func()) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	tmp, _ := ioutil.TempDir("", "sagacity")
+	upstream := filepath.Join(tmp, "upstream")
+	clone := filepath.Join(tmp, "clone")
+
+	os.Mkdir(upstream, 0755)
+	testGit(t, upstream, "init", "-q", "-b", "master")
+	ioutil.WriteFile(filepath.Join(upstream, "_repo.yaml"), []byte("key: upstream\n"), 0644)
+	ioutil.WriteFile(filepath.Join(upstream, "note.yaml"), []byte("type: info\n"), 0644)
+	testGit(t, upstream, "add", ".")
+	testGit(t, upstream, "commit", "-q", "-m", "first")
+	testGit(t, tmp, "clone", "-q", upstream, clone)
+	testGit(t, clone, "config", "user.name", "Test")
+	testGit(t, clone, "config", "user.email", "test@example.com")
+
+	return upstream, clone, func() { os.RemoveAll(tmp) }
+}
+
+func TestInspectRepo(t *testing.T) {
+	assert := assert.New(t)
+	upstream, clone, cleanup := testClone(t)
+	defer cleanup()
+
+	rc := RepoConfig{Path: clone}
+	repos, _ := LoadRepos(&Config{Repositories: []RepoConfig{rc}})
+	info := InspectRepo(rc, repos)
+
+	assert.Equal("upstream", info.Key)
+	assert.Equal(upstream, info.Remote)
+	assert.Equal("master", info.Branch)
+	assert.Equal(1, info.Items)
+	assert.True(info.Updated.IsZero())
+}
+
+func TestGitStatus(t *testing.T) {
+	assert := assert.New(t)
+	upstream, clone, cleanup := testClone(t)
+	defer cleanup()
+
+	st, err := GitStatus(clone)
+	assert.Nil(err)
+	assert.Equal(RepoStatus{}, st)
+
+	// One new commit upstream, one locally and a modified file
+	ioutil.WriteFile(filepath.Join(upstream, "other.yaml"), []byte("type: info\n"), 0644)
+	testGit(t, upstream, "add", ".")
+	testGit(t, upstream, "commit", "-q", "-m", "upstream")
+	testGit(t, clone, "fetch", "-q")
+	testGit(t, clone, "commit", "-q", "--allow-empty", "-m", "local")
+	ioutil.WriteFile(filepath.Join(clone, "note.yaml"), []byte("type: info\nbody: changed\n"), 0644)
+
+	st, err = GitStatus(clone)
+	assert.Nil(err)
+	assert.Equal(RepoStatus{Dirty: true, Ahead: 1, Behind: 1}, st)
+}
+
+func TestRemoveRepoAndSetRepoPath(t *testing.T) {
+	assert := assert.New(t)
+	tmp, _ := ioutil.TempDir("", "sagacity")
+	defer os.RemoveAll(tmp)
+
+	t.Setenv("SAGACITY_CACHE", filepath.Join(tmp, "items.cache"))
+	c := LoadConfig(filepath.Join(tmp, "config", "sagacity.yaml"))
+	c.RepoRoot = tmp
+	c.Repositories = []RepoConfig{
+		{Path: "test/repos/ref_tests/wiki"},
+		{Path: "test/repos/key_tests/one/topic"},
+	}
+	repos, _ := LoadRepos(c)
+
+	assert.Nil(SetRepoPath(c, repos, "topic", "test/repos/key_tests/two/topic"))
+	assert.Equal(absPath("test/repos/key_tests/two/topic"), c.Repositories[1].Path)
+	assert.NotNil(SetRepoPath(c, repos, "wiki", tmp))
+
+	// Only clones in the repository root are deleted
+	assert.EqualError(
+		RemoveRepo(c, repos, "wiki", true),
+		fmt.Sprintf("test/repos/ref_tests/wiki is not in %s, so sagacity does not delete it", tmp),
+	)
+	assert.DirExists("test/repos/ref_tests/wiki")
+
+	assert.Nil(RemoveRepo(c, repos, "wiki", false))
+	assert.NotNil(RemoveRepo(c, repos, "wiki", false))
+
+	saved := LoadConfig(c.filename)
+	assert.Equal(1, len(saved.Repositories))
+	assert.Equal(c.Repositories[0], saved.Repositories[0])
+}
+
+func TestRemoveRepoPurge(t *testing.T) {
+	assert := assert.New(t)
+	tmp, _ := ioutil.TempDir("", "sagacity")
+	defer os.RemoveAll(tmp)
+
+	clone := filepath.Join(tmp, "repos", "wiki")
+	local := filepath.Join(tmp, "repos", "notes")
+	for _, dir := range []string{clone, local} {
+		os.MkdirAll(dir, 0755)
+		ioutil.WriteFile(filepath.Join(dir, "_repo.yaml"), []byte("key: "+filepath.Base(dir)+"\n"), 0644)
+	}
+
+	t.Setenv("SAGACITY_CACHE", filepath.Join(tmp, "items.cache"))
+	c := LoadConfig(filepath.Join(tmp, "config", "sagacity.yaml"))
+	c.RepoRoot = filepath.Join(tmp, "repos")
+	c.Repositories = []RepoConfig{{Path: clone}, {Path: local, Type: LocalRepo}}
+	repos, _ := LoadRepos(c)
+
+	assert.EqualError(
+		RemoveRepo(c, repos, "notes", true),
+		local+" is a local repository, which sagacity does not delete",
+	)
+	assert.DirExists(local)
+	assert.Equal(2, len(c.Repositories))
+
+	assert.Nil(RemoveRepo(c, repos, "wiki", true))
+	assert.NoDirExists(clone)
+}
+
+// testCommit writes a file in a repository and commits it
+func testCommit(t *testing.T, dir, file, content string) {
+	ioutil.WriteFile(filepath.Join(dir, file), []byte(content), 0644)
+	testGit(t, dir, "add", ".")
+	testGit(t, dir, "commit", "-q", "-m", "change "+file)
+}
+
+func TestUpdateReposPullsAndReportsEachRepo(t *testing.T) {
+	assert := assert.New(t)
+	upstream, clone, cleanup := testClone(t)
+	defer cleanup()
+
+	c := &Config{Repositories: []RepoConfig{
+		{Path: clone},
+		{Path: filepath.Join(clone, "nonexistant")},
+	}}
+	repos, _ := LoadRepos(c)
+
+	testCommit(t, upstream, "other.yaml", "type: info\n")
+	results := UpdateRepos(c, repos, UpdateOptions{Jobs: 2})
+
+	assert.Equal(2, len(results))
+	assert.Equal("upstream", results[0].Key)
+	assert.Equal(Updated, results[0].Status)
+	assert.Equal(Failed, results[1].Status)
+	assert.FileExists(filepath.Join(clone, "other.yaml"))
+
+	results = UpdateRepos(c, repos, UpdateOptions{Jobs: 2})
+	assert.Equal(UpToDate, results[0].Status)
+}
+
+func TestUpdateReposSkipsDirtyRepos(t *testing.T) {
+	assert := assert.New(t)
+	upstream, clone, cleanup := testClone(t)
+	defer cleanup()
+
+	c := &Config{Repositories: []RepoConfig{{Path: clone}}}
+	testCommit(t, upstream, "other.yaml", "type: info\n")
+	ioutil.WriteFile(filepath.Join(clone, "note.yaml"), []byte("type: info\nbody: mine\n"), 0644)
+
+	results := UpdateRepos(c, nil, UpdateOptions{})
+	assert.Equal(Skipped, results[0].Status)
+
+	results = UpdateRepos(c, nil, UpdateOptions{AllowDirty: true})
+	assert.Equal(Updated, results[0].Status)
+}
+
+func TestUpdateReposAbortsConflicts(t *testing.T) {
+	assert := assert.New(t)
+	upstream, clone, cleanup := testClone(t)
+	defer cleanup()
+
+	c := &Config{Repositories: []RepoConfig{{Path: clone}}}
+	testCommit(t, upstream, "note.yaml", "type: info\nbody: theirs\n")
+	testCommit(t, clone, "note.yaml", "type: info\nbody: ours\n")
+
+	results := UpdateRepos(c, nil, UpdateOptions{})
+	assert.Equal(Conflict, results[0].Status)
+	assert.Contains(results[0].Detail, "note.yaml")
+
+	st, _ := GitStatus(clone)
+	assert.False(st.Dirty)
+}
+
+func TestUpdateReposFollowsConfiguredBranch(t *testing.T) {
+	assert := assert.New(t)
+	upstream, clone, cleanup := testClone(t)
+	defer cleanup()
+
+	testGit(t, upstream, "checkout", "-q", "-b", "stable")
+	testCommit(t, upstream, "stable.yaml", "type: info\n")
+	testGit(t, upstream, "checkout", "-q", "master")
+
+	c := &Config{Repositories: []RepoConfig{{Path: clone, Branch: "stable"}}}
+	results := UpdateRepos(c, nil, UpdateOptions{})
+
+	assert.Equal(Updated, results[0].Status)
+	branch, _ := gitOutput(clone, "rev-parse", "--abbrev-ref", "HEAD")
+	assert.Equal("stable", branch)
+	assert.FileExists(filepath.Join(clone, "stable.yaml"))
+}
+
+func TestUpdateReposWithLocalUpstream(t *testing.T) {
+	assert := assert.New(t)
+	upstream, clone, cleanup := testClone(t)
+	defer cleanup()
+
+	// A branch that tracks another local branch, rather than a remote one
+	testGit(t, clone, "checkout", "-q", "-b", "work", "--track", "master")
+	testGit(t, upstream, "checkout", "-q", "-b", "work")
+	testCommit(t, upstream, "work.yaml", "type: info\n")
+
+	remote, branch, err := trackedBranch(RepoConfig{Path: clone})
+	assert.Nil(err)
+	assert.Equal("origin", remote)
+	assert.Equal("work", branch)
+
+	results := UpdateRepos(&Config{Repositories: []RepoConfig{{Path: clone}}}, nil, UpdateOptions{})
+	assert.Equal(Updated, results[0].Status)
+	assert.FileExists(filepath.Join(clone, "work.yaml"))
+}
+
+func TestUpdateReposChecksOutPinnedRefs(t *testing.T) {
+	assert := assert.New(t)
+	upstream, clone, cleanup := testClone(t)
+	defer cleanup()
+
+	testGit(t, upstream, "tag", "v1")
+	v1, _ := gitOutput(upstream, "rev-parse", "HEAD")
+	testCommit(t, upstream, "other.yaml", "type: info\n")
+	tip, _ := gitOutput(upstream, "rev-parse", "HEAD")
+	testCommit(t, upstream, "third.yaml", "type: info\n")
+
+	c := &Config{Repositories: []RepoConfig{{Path: clone, Ref: "v1"}}}
+	head := func() string {
+		commit, _ := gitOutput(clone, "rev-parse", "HEAD")
+		return commit
+	}
+
+	// The clone is already at v1
+	results := UpdateRepos(c, nil, UpdateOptions{})
+	assert.Equal(UpToDate, results[0].Status)
+	assert.Equal(v1, head())
+
+	c.Repositories[0].Ref = tip
+	results = UpdateRepos(c, nil, UpdateOptions{})
+	assert.Equal(Updated, results[0].Status)
+	assert.Equal(tip, head())
+
+	c.Repositories[0].Ref = "master"
+	results = UpdateRepos(c, nil, UpdateOptions{})
+	assert.Equal(Updated, results[0].Status)
+	upstreamHead, _ := gitOutput(upstream, "rev-parse", "HEAD")
+	assert.Equal(upstreamHead, head())
+
+	c.Repositories[0].Ref = "nope"
+	results = UpdateRepos(c, nil, UpdateOptions{})
+	assert.Equal(Failed, results[0].Status)
+
+	// Unpinning goes back to following the default branch
+	c.Repositories[0].Ref = ""
+	results = UpdateRepos(c, nil, UpdateOptions{})
+	assert.NotEqual(Failed, results[0].Status)
+	branch, _ := gitOutput(clone, "rev-parse", "--abbrev-ref", "HEAD")
+	assert.Equal("master", branch)
+}
+
+func TestPinRepo(t *testing.T) {
+	assert := assert.New(t)
+	c, _, cleanup := testArchiveConfig(t)
+	defer cleanup()
+
+	c.Repositories = []RepoConfig{{Path: "test/repos/ref_tests/wiki"}}
+	AddLocalRepo(c, "test/repos/key_tests/one/topic", RepoConfig{})
+
+	assert.Nil(PinRepo(c, nil, "wiki", "v1.2"))
+	assert.NotNil(PinRepo(c, nil, "topic", "v1.2"))
+
+	saved := LoadConfig(c.filename)
+	assert.Equal("v1.2", saved.Repositories[0].Ref)
+
+	assert.Nil(PinRepo(c, nil, "wiki", ""))
+	assert.Equal("", c.Repositories[0].Ref)
+}
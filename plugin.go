@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/codegangsta/cli"
+	"gopkg.in/yaml.v3"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// pluginProtocol is the version of the protocol spoken with plugins
+const pluginProtocol = 1
+
+// pluginPrefix is the prefix of plugin executables that are found on $PATH
+const pluginPrefix = "sagacity-type-"
+
+// describeTimeout limits how long a plugin can take to describe an item, since
+// a hanging plugin would hang every invocation
+const describeTimeout = 5 * time.Second
+
+func init() {
+	gob.Register(&PluginItem{})
+}
+
+// PluginItem is an item whose type is implemented by an external executable,
+// which answers JSON requests on stdin with JSON responses on stdout
+type PluginItem struct {
+	RawType     string          `yaml:"type"`
+	RawSummary  string          `yaml:"summary"`
+	RawAlias    string          `yaml:"alias"`
+	SeeAlso     []string        `yaml:"see_also"`
+	Command     string          `yaml:"-"`
+	Data        json.RawMessage `yaml:"-"`
+	Subcommands []PluginCommand `yaml:"-"`
+	id          string
+	path        string
+	repo        *Repo
+}
+
+// PluginCommand is a subcommand of a plugin item
+type PluginCommand struct {
+	Name  string `json:"name"`
+	Usage string `json:"usage"`
+}
+
+// PluginRequest is what is sent to the plugin executable
+type PluginRequest struct {
+	Version int             `json:"version"`
+	Action  string          `json:"action"` // "describe" or "execute"
+	Type    string          `json:"type"`
+	ID      string          `json:"id"`
+	Path    string          `json:"path"`
+	Item    json.RawMessage `json:"item"` // the whole YAML file, as JSON
+
+	// Set when executing
+	Subcommand string   `json:"subcommand,omitempty"`
+	Args       []string `json:"args,omitempty"`
+}
+
+// PluginResponse is what the plugin executable answers with
+type PluginResponse struct {
+	// Set when describing
+	Summary     string          `json:"summary,omitempty"`
+	Subcommands []PluginCommand `json:"subcommands,omitempty"`
+
+	// Set when executing
+	Output string `json:"output,omitempty"`
+
+	// Error is set if the request failed
+	Error string `json:"error,omitempty"`
+}
+
+// pluginPaths adds the plugins declared in a _repo.yaml to the ones declared
+// by its parents. Relative executables are relative to the repository.
+func pluginPaths(inherited, declared map[string]string, dir string) map[string]string {
+	if len(declared) == 0 {
+		return inherited
+	}
+
+	plugins := make(map[string]string, len(inherited)+len(declared))
+	for name, command := range inherited {
+		plugins[name] = command
+	}
+
+	for name, command := range declared {
+		fields := strings.Fields(command)
+		if len(fields) != 0 && strings.Contains(fields[0], "/") && !filepath.IsAbs(fields[0]) {
+			fields[0] = filepath.Join(dir, fields[0])
+		}
+		plugins[name] = strings.Join(fields, " ")
+	}
+	return plugins
+}
+
+// findPlugin returns the command that implements an item type, if any
+func findPlugin(r *Repo, name string) (string, bool) {
+	if command, ok := r.plugins[name]; ok {
+		return command, true
+	}
+
+	if path, err := exec.LookPath(pluginPrefix + name); err == nil {
+		return path, true
+	}
+	return "", false
+}
+
+// stalePlugin tells if an item was created by a plugin that is no longer the
+// one for its type
+func stalePlugin(r *Repo, item Item) bool {
+	p, ok := item.(*PluginItem)
+	if !ok {
+		return false
+	}
+
+	command, ok := findPlugin(r, p.RawType)
+	return !ok || command != p.Command
+}
+
+// loadPlugin creates a PluginItem for a file and asks the plugin to describe it,
+// so that the description is cached along with the item
+func loadPlugin(r *Repo, p, name, command string, node *yaml.Node) (Item, error) {
+	item := &PluginItem{RawType: name, Command: command}
+	item.bind(r, p)
+
+	data := make(map[string]interface{})
+	if node != nil {
+		if err := node.Decode(item); err != nil {
+			return nil, fmt.Errorf("%s: %s", p, err)
+		}
+		if err := node.Decode(&data); err != nil {
+			return nil, fmt.Errorf("%s: %s", p, err)
+		}
+	}
+
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", p, err)
+	}
+	item.Data = raw
+
+	ctx, cancel := context.WithTimeout(context.Background(), describeTimeout)
+	defer cancel()
+
+	resp, err := item.request(ctx, PluginRequest{Action: "describe"})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", p, err)
+	}
+
+	if resp.Summary != "" {
+		item.RawSummary = resp.Summary
+	}
+	item.Subcommands = resp.Subcommands
+
+	return item, nil
+}
+
+// request runs the plugin executable with a request
+func (p *PluginItem) request(ctx context.Context, req PluginRequest) (*PluginResponse, error) {
+	req.Version = pluginProtocol
+	req.Type = p.RawType
+	req.ID = p.id
+	req.Path = p.path
+	req.Item = p.Data
+
+	in, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := strings.Fields(p.Command)
+	if len(fields) == 0 {
+		return nil, errors.New("No plugin command")
+	}
+
+	if err := verifyCheckoutOnce(p.repo.config); err != nil {
+		return nil, fmt.Errorf("Refusing to run plugin %s for an unverified repository: %s", p.Command, err)
+	}
+
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, fields[0], fields[1:]...)
+	cmd.Stdin = bytes.NewReader(in)
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("plugin %s failed: %s", p.Command, err)
+	}
+
+	var resp PluginResponse
+	if err := json.Unmarshal(out.Bytes(), &resp); err != nil {
+		return nil, fmt.Errorf("plugin %s answered with invalid JSON: %s", p.Command, err)
+	}
+
+	if resp.Error != "" {
+		return &resp, errors.New(resp.Error)
+	}
+	return &resp, nil
+}
+
+// run asks the plugin to execute the item and prints the output
+func (p *PluginItem) run(subcommand string, args []string) {
+	resp, err := p.request(context.Background(), PluginRequest{
+		Action:     "execute",
+		Subcommand: subcommand,
+		Args:       args,
+	})
+
+	if resp != nil && resp.Output != "" {
+		fmt.Print(resp.Output)
+		if !strings.HasSuffix(resp.Output, "\n") {
+			fmt.Println()
+		}
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (p PluginItem) String() string {
+	return fmt.Sprintf("P: %s (%s)", p.ID(), p.RawType)
+}
+
+// Execute asks the plugin to execute the item
+func (p *PluginItem) Execute(c *cli.Context) {
+	p.run("", c.Args())
+}
+
+// MakeCLI creates the subcommands that the plugin described
+func (p *PluginItem) MakeCLI() []cli.Command {
+	sc := make([]cli.Command, 0, len(p.Subcommands))
+	for _, sub := range p.Subcommands {
+		name := sub.Name
+		sc = append(sc, cli.Command{
+			Name:     name,
+			Usage:    sub.Usage,
+			HideHelp: true,
+			Action: func(c *cli.Context) {
+				p.run(name, c.Args())
+			},
+		})
+	}
+	return sc
+}
+
+// ID returns the ID of the item
+func (p PluginItem) ID() string {
+	return p.id
+}
+
+// Type returns the Type of the item
+func (p PluginItem) Type() string {
+	return p.RawType
+}
+
+// Path returns the path of the item
+func (p PluginItem) Path() string {
+	return p.path
+}
+
+// Alias returns the alias of the item
+func (p PluginItem) Alias() string {
+	return p.RawAlias
+}
+
+// Summary returns the summary of the item
+func (p PluginItem) Summary() string {
+	return p.RawSummary
+}
+
+// References returns the `see_also` references of the item
+func (p PluginItem) References() []string {
+	return p.SeeAlso
+}
+
+// bind sets the fields of the item that are not read from its file
+func (p *PluginItem) bind(r *Repo, path string) {
+	p.id = asKey(path)
+	p.path = path
+	p.repo = r
+}
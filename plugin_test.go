@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestHelperPlugin is not a real test. It is run as a plugin by the other
+// tests, in a process of its own.
+func TestHelperPlugin(t *testing.T) {
+	if os.Getenv("SAGACITY_HELPER_PLUGIN") != "1" {
+		return
+	}
+	defer os.Exit(0)
+
+	var req PluginRequest
+	json.NewDecoder(os.Stdin).Decode(&req)
+
+	var item map[string]interface{}
+	json.Unmarshal(req.Item, &item)
+
+	var resp PluginResponse
+	switch req.Action {
+	case "describe":
+		resp.Summary = fmt.Sprintf("Query against %v", item["database"])
+		resp.Subcommands = []PluginCommand{{Name: "explain", Usage: "Explain the query"}}
+	case "execute":
+		resp.Output = fmt.Sprintf("%s %s %s", req.ID, req.Subcommand, strings.Join(req.Args, " "))
+		if req.Subcommand == "fail" {
+			resp.Error = "it failed"
+		}
+	}
+
+	json.NewEncoder(os.Stdout).Encode(resp)
+}
+
+// testPluginRepo creates a repository with a `sql` plugin item type
+func testPluginRepo(t *testing.T) string {
+	t.Setenv("SAGACITY_HELPER_PLUGIN", "1")
+	dir := t.TempDir()
+
+	repo := fmt.Sprintf("key: db\nplugins:\n  sql: %s -test.run=TestHelperPlugin --\n", os.Args[0])
+	ioutil.WriteFile(filepath.Join(dir, "_repo.yaml"), []byte(repo), 0644)
+	os.Mkdir(filepath.Join(dir, "reports"), 0755)
+	ioutil.WriteFile(
+		filepath.Join(dir, "reports", "slow.yaml"),
+		[]byte("type: sql\nalias: sq\ndatabase: orders\nquery: SELECT 1\n"),
+		0644,
+	)
+	return dir
+}
+
+func TestPluginPaths(t *testing.T) {
+	assert := assert.New(t)
+
+	inherited := map[string]string{"sql": "/usr/bin/sql", "csv": "csv-tool"}
+	declared := map[string]string{"sql": "tools/sql.py --strict", "graph": "python3 graph.py"}
+
+	plugins := pluginPaths(inherited, declared, "/repo")
+
+	assert.Equal(map[string]string{
+		"sql":   "/repo/tools/sql.py --strict",
+		"csv":   "csv-tool",
+		"graph": "python3 graph.py",
+	}, plugins)
+	assert.Equal("/usr/bin/sql", inherited["sql"])
+}
+
+func TestPluginItemsAreDescribedWhenLoaded(t *testing.T) {
+	assert := assert.New(t)
+	dir := testPluginRepo(t)
+
+	r := NewRepo(dir)
+	item := r.Subrepos["reports"].Items["slow"]
+
+	p, ok := item.(*PluginItem)
+	assert.True(ok)
+	assert.Equal("sql", p.Type())
+	assert.Equal("sq", p.Alias())
+	assert.Equal("Query against orders", p.Summary())
+
+	sc := p.MakeCLI()
+	assert.Equal(1, len(sc))
+	assert.Equal("explain", sc[0].Name)
+	assert.Equal("Explain the query", sc[0].Usage)
+}
+
+func TestPluginItemsAreExecuted(t *testing.T) {
+	assert := assert.New(t)
+	dir := testPluginRepo(t)
+
+	p := NewRepo(dir).Subrepos["reports"].Items["slow"].(*PluginItem)
+
+	resp, err := p.request(context.Background(), PluginRequest{Action: "execute", Subcommand: "explain", Args: []string{"now"}})
+	assert.Nil(err)
+	assert.Equal("slow explain now", resp.Output)
+
+	_, err = p.request(context.Background(), PluginRequest{Action: "execute", Subcommand: "fail"})
+	assert.EqualError(err, "it failed")
+}
+
+func TestPluginsRefuseUnverifiedRepos(t *testing.T) {
+	assert := assert.New(t)
+	dir := testPluginRepo(t)
+
+	// Local repositories cannot be verified, so their plugins never run
+	rc := RepoConfig{Path: dir, Type: LocalRepo, Verify: &SignaturePolicy{Keys: []string{"SHA256:abc"}}}
+	r := newRepo(dir, loadContext{config: rc})
+	assert.Empty(r.Subrepos["reports"].Items)
+
+	p := NewRepo(dir).Subrepos["reports"].Items["slow"].(*PluginItem)
+	p.repo.config = rc
+	_, err := p.request(context.Background(), PluginRequest{Action: "execute", Subcommand: "explain"})
+	assert.Contains(err.Error(), "Refusing to run plugin")
+}
+
+func TestPluginItemsAreCached(t *testing.T) {
+	assert := assert.New(t)
+	dir := testPluginRepo(t)
+
+	fn := filepath.Join(dir, "items.cache")
+	cache := LoadCache(fn)
+	newRepo(dir, loadContext{cache: cache})
+	assert.Nil(cache.Save())
+
+	cache = LoadCache(fn)
+	r := newRepo(dir, loadContext{cache: cache})
+	assert.Equal("Query against orders", r.Subrepos["reports"].Items["slow"].Summary())
+	assert.Equal(0, len(cache.entries))
+	assert.False(cache.changed)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fatih/color"
+	"regexp"
+	"strings"
+)
+
+// linkRxp matches inline links in item bodies, e.g. `[[printout hosts db]]`
+var linkRxp = regexp.MustCompile(`\[\[([^\]]+)\]\]`)
+
+// ResolveRef returns the Item that a reference, like `printout hosts db`, points to
+func ResolveRef(repos map[string]*Repo, ref string) (Item, error) {
+	args := strings.Fields(ref)
+	if len(args) < 2 {
+		return nil, errors.New("Too few identifiers in reference. Need at least 2.")
+	}
+
+	repo, ok := findRepo(repos, args[0])
+	if !ok {
+		return nil, fmt.Errorf("No such repository: %s", args[0])
+	}
+
+	item, remaining, err := repo.GetItem(args[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	if len(remaining) != 0 {
+		return nil, fmt.Errorf("Trailing identifiers in reference: %s", strings.Join(remaining, " "))
+	}
+
+	return item, nil
+}
+
+// parseLinks returns the references of all the inline links in a text
+func parseLinks(body string) (refs []string) {
+	for _, match := range linkRxp.FindAllStringSubmatch(body, -1) {
+		refs = append(refs, strings.TrimSpace(match[1]))
+	}
+
+	return
+}
+
+// renderLinks replaces the inline links in a text with the items they point to
+func renderLinks(repos map[string]*Repo, body string) string {
+	return linkRxp.ReplaceAllStringFunc(body, func(link string) string {
+		ref := strings.TrimSpace(linkRxp.FindStringSubmatch(link)[1])
+
+		item, err := ResolveRef(repos, ref)
+		if err != nil {
+			return fmt.Sprintf("%s (broken reference)", ref)
+		}
+
+		if item.Summary() == "" {
+			return item.ID()
+		}
+		return fmt.Sprintf("%s (%s)", item.ID(), item.Summary())
+	})
+}
+
+// printSeeAlso prints the `see_also` section of an item, if it has one
+func printSeeAlso(repos map[string]*Repo, refs []string) {
+	if len(refs) == 0 {
+		return
+	}
+
+	fmt.Println()
+	printRefs(repos, "See also:", refs)
+}
+
+// printRefs prints a list of references along with the summaries of the items
+// they point to
+func printRefs(repos map[string]*Repo, heading string, refs []string) {
+	cyan := color.New(color.FgCyan, color.Bold).SprintfFunc()
+	red := color.New(color.FgRed, color.Bold).SprintfFunc()
+
+	fmt.Println(heading)
+	for _, ref := range refs {
+		item, err := ResolveRef(repos, ref)
+		if err != nil {
+			fmt.Printf("  %s (%s)\n", cyan(ref), red("broken reference"))
+			continue
+		}
+
+		fmt.Printf("  %s: %s\n", cyan(ref), item.Summary())
+	}
+}
+
+// Backlinks returns the references of all the items in the repositories that
+// refer to `target`
+func Backlinks(repos map[string]*Repo, target Item) (refs []string) {
+	for _, key := range repoKeys(repos) {
+		repos[key].Walk(func(ref string, item Item) {
+			for _, r := range item.References() {
+				found, err := ResolveRef(repos, r)
+				if err == nil && found.Path() == target.Path() {
+					refs = append(refs, ref)
+					return
+				}
+			}
+		})
+	}
+
+	return
+}
+
+// PrintBacklinks prints the items that refer to `target`
+func PrintBacklinks(repos map[string]*Repo, target Item) {
+	refs := Backlinks(repos, target)
+	if len(refs) == 0 {
+		fmt.Println("Nothing refers to", target.ID())
+		return
+	}
+
+	printRefs(repos, "Referred to by:", refs)
+}
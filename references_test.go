@@ -0,0 +1,66 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func testRefRepos() map[string]*Repo {
+	repos, _ := LoadRepos(&Config{
+		Repositories: []RepoConfig{{Path: "test/repos/ref_tests/wiki"}},
+	})
+	return repos
+}
+
+func TestResolveRefFindsItem(t *testing.T) {
+	assert := assert.New(t)
+	repos := testRefRepos()
+
+	item, err := ResolveRef(repos, "wiki guides deploy")
+
+	assert.Nil(err)
+	assert.Equal("deploy", item.ID())
+}
+
+func TestResolveRefFailsOnBrokenReferences(t *testing.T) {
+	assert := assert.New(t)
+	repos := testRefRepos()
+
+	for _, ref := range []string{"wiki", "nope intro", "wiki nowhere", "wiki guides", "wiki intro extra"} {
+		_, err := ResolveRef(repos, ref)
+		assert.NotNil(err, ref)
+	}
+}
+
+func TestInfoReferencesIncludeInlineLinks(t *testing.T) {
+	assert := assert.New(t)
+	repos := testRefRepos()
+
+	refs := repos["wiki"].Items["intro"].References()
+
+	assert.Equal([]string{
+		"wiki guides deploy",
+		"wiki nowhere",
+		"wiki guides deploy",
+		"wiki guides missing",
+	}, refs)
+}
+
+func TestRenderLinks(t *testing.T) {
+	assert := assert.New(t)
+	repos := testRefRepos()
+
+	out := renderLinks(repos, "See [[wiki guides deploy]] and [[ wiki nope ]].")
+
+	assert.Equal("See deploy (How deploys work) and wiki nope (broken reference).", out)
+}
+
+func TestBacklinks(t *testing.T) {
+	assert := assert.New(t)
+	repos := testRefRepos()
+
+	target, _ := ResolveRef(repos, "wiki guides deploy")
+	refs := Backlinks(repos, target)
+
+	assert.Equal([]string{"wiki intro", "wiki guides rollback"}, refs)
+}
@@ -4,7 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/codegangsta/cli"
-	"gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
 	"io/ioutil"
 	"log"
 	"os"
@@ -16,14 +16,41 @@ import (
 
 // Repo represents a repository of information yaml files.
 type Repo struct {
-	Key      string `yaml:"key"`
-	Summary  string `yaml:"summary"`
-	Alias    string `yaml:"alias"`
-	Items    map[string]Item
-	Control  map[string]Item
-	Subrepos map[string]*Repo
-	Parent   *Repo
-	root     string
+	Key        string            `yaml:"key"`
+	Summary    string            `yaml:"summary"`
+	Alias      string            `yaml:"alias"`
+	Plugins    map[string]string `yaml:"plugins"`
+	Windows    []Window          `yaml:"windows"`
+	Freezes    []Freeze          `yaml:"freezes"`
+	Approval   *ApprovalPolicy   `yaml:"approval"`
+	Items      map[string]Item
+	Control    map[string]Item
+	Subrepos   map[string]*Repo
+	Parent     *Repo `yaml:"-"`
+	root       string
+	repos      map[string]*Repo
+	config     RepoConfig
+	plugins    map[string]string
+	defaults   Defaults
+	transport  Transport
+	yesRisk    string
+	signingKey string
+}
+
+// loadContext is what repositories pass on to their subrepos while loading
+type loadContext struct {
+	cache *ItemCache
+
+	// config is the configuration of the repository being loaded, which
+	// plugins need to verify the checkout before they run
+	config RepoConfig
+
+	// plugins are the plugin item types declared by the parent repositories
+	plugins map[string]string
+
+	// defaults and ignore are the merged control files of the parents
+	defaults Defaults
+	ignore   []ignoreRule
 }
 
 func (r Repo) String() string {
@@ -31,69 +58,155 @@ func (r Repo) String() string {
 }
 
 // LoadRepos loads multiple repositories and stores them
-func LoadRepos(c *Config) (repos map[string]*Repo) {
+//
+// Colliding keys and aliases are reported as an error, along with the repos.
+func LoadRepos(c *Config) (repos map[string]*Repo, err error) {
 	repos = make(map[string]*Repo)
-	cr := make(chan *Repo)
+	loaded := make([]*Repo, len(c.Repositories))
+	done := make(chan bool)
+
+	var cache *ItemCache
+	if c.cache != "" {
+		cache = LoadCache(c.cache)
+	}
+
+	transport, err := NewTransport(c.SSH)
+	if err != nil {
+		return nil, err
+	}
 
 	started := 0
-	for _, file := range c.Repositories {
-		if _, err := os.Stat(filepath.Join(file, "_repo.yaml")); os.IsNotExist(err) {
+	for x, rc := range c.Repositories {
+		if _, err := os.Stat(filepath.Join(rc.Path, "_repo.yaml")); os.IsNotExist(err) {
 			// log.Println(fmt.Sprintf("Skipping repo %s: no _repo.yaml found.", file.Name()))
 			continue
 		}
 
 		started++
-		go func(c chan<- *Repo, fn string) {
-			c <- NewRepo(fn)
-		}(cr, file)
+		go func(x int, rc RepoConfig) {
+			r := newRepo(rc.Path, loadContext{cache: cache, config: rc})
+			r.Key = rc.LoadedKey()
+			loaded[x] = r
+			done <- true
+		}(x, rc)
 	}
 
 	for x := 0; x < started; x++ {
-		r := <-cr
-		if r != nil {
-			repos[r.Key] = r
+		<-done
+	}
+
+	if cache != nil {
+		if err := cache.Save(); err != nil {
+			log.Println("Saving the item cache failed: ", err)
 		}
 	}
 
-	return
-}
+	var errs []string
+	for _, r := range loaded {
+		if r == nil {
+			continue
+		}
+
+		if other, ok := repos[r.Key]; ok {
+			errs = append(errs, fmt.Sprintf(
+				"repositories %s and %s both use the key %q; set a key or namespace for one of them in the config",
+				other.root, r.root, r.Key,
+			))
+			continue
+		}
+		repos[r.Key] = r
+	}
+
+	// Give every repository in the tree access to its siblings so that
+	// references across repositories can be resolved, and a shared transport
+	// so that connections to hosts can be reused.
+	for _, r := range repos {
+		r.eachRepo(func(sub *Repo) {
+			sub.repos = repos
+			sub.transport = transport
+			sub.yesRisk = c.YesRisk
+			sub.signingKey = c.SigningKey
+		})
+	}
+
+	if err := checkNames(repos); err != nil {
+		errs = append(errs, err.Error())
+	}
 
-// UpdateRepos will run git pull on the repos
-func UpdateRepos(repos map[string]*Repo) {
-	for key, repo := range repos {
-		log.Printf("Updating %s...", key)
-		repo.git("pull", "origin", "master")
+	if len(errs) != 0 {
+		err = errors.New(strings.Join(errs, "\n"))
 	}
+	return
 }
 
-// AddRepo clones a new repository
-func AddRepo(config *Config, url string) {
-	// Clean the name of prefixes and stuff, leaving just the trailing word. This
-	// lets us use `saga-topic` or `kb-topic` or whatever and we'll still get
-	// just `topic` when we're grabbing.
-	rxp := regexp.MustCompile(".*-")
-	name := rxp.ReplaceAllString(url, "")
+// AddRepo clones a new repository and adds it to the configuration
+func AddRepo(config *Config, url string, rc RepoConfig) {
+	name := repoName(url)
+
+	// Namespaced repositories are cloned into a directory of their own, so
+	// that repositories with the same name from different teams can coexist.
+	dir := filepath.Join(config.RepoRoot, rc.Namespace, name)
 
 	// Clone the repo! |o/
-	dir := filepath.Join(config.RepoRoot, name)
-	git("", "clone", url, dir)
+	if err := git("", "clone", url, dir); err != nil {
+		log.Fatal("git clone failed: ", err)
+	}
 
 	// Persist the changes into the configuration file
-	err := config.AddRepo(dir)
+	rc.Path = dir
+	err := config.AddRepo(rc)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	log.Printf("Added %s as %s!\n", url, name)
+	log.Printf("Added %s as %s!\n", url, rc.LoadedKey())
+}
+
+// repoName derives the name of a repository from its clone URL
+//
+// The name is cleaned of prefixes and stuff, leaving just the trailing word.
+// This lets us use `saga-topic` or `kb-topic` or whatever and we'll still get
+// just `topic` when we're grabbing.
+func repoName(url string) string {
+	name := strings.TrimSuffix(strings.TrimRight(url, "/"), ".git")
+
+	// Both `https://host/team/repo` and `git@host:team/repo` end in the name.
+	if x := strings.LastIndexAny(name, "/:"); x != -1 {
+		name = name[x+1:]
+	}
+
+	rxp := regexp.MustCompile(".*-")
+	return rxp.ReplaceAllString(name, "")
+}
+
+// declaredKey returns the key that a repository gives itself, from its
+// _repo.yaml or else its directory name
+func declaredKey(p string) string {
+	var declared struct {
+		Key string `yaml:"key"`
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(p, "_repo.yaml")); err == nil {
+		yaml.Unmarshal(data, &declared)
+	}
+
+	if declared.Key != "" {
+		return declared.Key
+	}
+	return asKey(absPath(p))
 }
 
 // NewRepo loads a repository on a path
 func NewRepo(p string) *Repo {
+	return newRepo(p, loadContext{})
+}
+
+// newRepo loads a repository on a path, in the context of its parents
+func newRepo(p string, ctx loadContext) *Repo {
 	var subdirs []string
-	var items []string
+	var items []os.FileInfo
 
 	p = getPath(p)
-	r := Repo{Key: asKey(p), root: p}
+	r := Repo{Key: asKey(p), root: p, config: ctx.config}
 
 	// Check if this is a root repo. If it is, load the data from the _repo.yaml file into
 	// the newly created repo.
@@ -107,6 +220,33 @@ func NewRepo(p string) *Repo {
 		yaml.Unmarshal(data, &r)
 	}
 
+	// Plugins declared here are added to the ones of the parents, and passed
+	// on to the subrepos.
+	r.plugins = pluginPaths(ctx.plugins, r.Plugins, p)
+	ctx.plugins = r.plugins
+
+	// So are the control files, see defaults.go.
+	var defaults Defaults
+	if err := readControl(p, defaultsFile, &defaults); err != nil {
+		log.Println("Failed to load defaults: ", err)
+	}
+	r.defaults = ctx.defaults.Merge(defaults)
+	ctx.defaults = r.defaults
+
+	var ignore Ignore
+	if err := readControl(p, ignoreFile, &ignore); err != nil {
+		log.Println("Failed to load ignore patterns: ", err)
+	}
+	if len(ignore.Patterns) != 0 {
+		// Copy the rules, since the siblings of this repo share the slice.
+		rules := make([]ignoreRule, len(ctx.ignore), len(ctx.ignore)+len(ignore.Patterns))
+		copy(rules, ctx.ignore)
+		for _, pattern := range ignore.Patterns {
+			rules = append(rules, ignoreRule{dir: p, pattern: pattern})
+		}
+		ctx.ignore = rules
+	}
+
 	r.Items = make(map[string]Item)
 	r.Control = make(map[string]Item)
 	r.Subrepos = make(map[string]*Repo)
@@ -121,10 +261,14 @@ func NewRepo(p string) *Repo {
 			continue
 		}
 
+		if ignored(ctx.ignore, fn) {
+			continue
+		}
+
 		if f.IsDir() {
 			subdirs = append(subdirs, fn)
 		} else if strings.HasSuffix(fn, ".yaml") {
-			items = append(items, fn)
+			items = append(items, f)
 		}
 	}
 
@@ -134,22 +278,27 @@ func NewRepo(p string) *Repo {
 	// Start parsing subrepos
 	for _, dir := range subdirs {
 		go func(cs chan<- *Repo, dir string) {
-			nr := NewRepo(dir)
+			nr := newRepo(dir, ctx)
 			cs <- nr
 		}(cs, dir)
 	}
 
 	// Start parsing items
-	for _, fn := range items {
-		go func(ci chan<- Item, fn string) {
-			ni := r.loadItem(fn)
+	for _, f := range items {
+		go func(ci chan<- Item, f os.FileInfo) {
+			ni := r.loadItem(filepath.Join(p, f.Name()), f, ctx.cache)
 			ci <- ni
-		}(ci, fn)
+		}(ci, f)
 	}
 
 	// Drain the items first
 	for x := 0; x < len(items); x++ {
 		item := <-ci
+		if item == nil {
+			// Failed to load; loadItem has already said why.
+			continue
+		}
+
 		// Control files start with an underscore and should not be stored as
 		// normal Item documents.
 		path := item.Path()
@@ -164,23 +313,22 @@ func NewRepo(p string) *Repo {
 	// And then drain the subrepos
 	for x := 0; x < len(subdirs); x++ {
 		sub := <-cs
+		sub.Parent = &r
 		r.Subrepos[sub.Key] = sub
 	}
 
 	return &r
 }
 
-// ListRepos prints a sorted list of available repostiories.
-func ListRepos(repos map[string]Repo) {
+// repoKeys returns a sorted list of the keys in a repository map
+func repoKeys(repos map[string]*Repo) []string {
 	keys := make([]string, 0, len(repos))
 	for key := range repos {
 		keys = append(keys, key)
 	}
 
 	sort.Strings(keys)
-	for _, key := range keys {
-		fmt.Println(key)
-	}
+	return keys
 }
 
 // Keys returns a sorted list of the info keys in the repository
@@ -209,26 +357,118 @@ func (r *Repo) SubrepoKeys() []string {
 
 // GetHost will return a Host as defined by the list of arguments
 //
-// `args` is to be a string containing space separated identifiers to find a
-// host category.
-func (r *Repo) GetHost(def string) (h *Host) {
-	args := strings.Split(def, " ")
+// `def` is space separated identifiers of a host category, like "db master",
+// looked up in the closest `hosts` subrepo, or in another repository when given
+// as "infra:hosts db master".
+func (r *Repo) GetHost(def string) (*Host, error) {
+	hosts, err := r.GetHosts(def)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(hosts) != 1 {
+		return nil, fmt.Errorf("%q is %d hosts, but only one can be used here", def, len(hosts))
+	}
+	return hosts[0], nil
+}
+
+// GetHosts is GetHost for definitions that can be more than one host, like
+// "db ro all"
+func (r *Repo) GetHosts(def string) ([]*Host, error) {
+	args := strings.Fields(def)
+	if len(args) != 0 && strings.Contains(args[0], ":") {
+		x := strings.Index(def, ":")
+		return r.getQualifiedHost(strings.TrimSpace(def[:x]), def[x+1:])
+	}
+
 	if len(args) < 2 {
-		log.Fatal("Too few identifiers in host string. Need at least 2.")
+		return nil, fmt.Errorf("Too few identifiers in host string %q. Need at least 2.", def)
 	}
 
-	args = append([]string{"hosts"}, args...)
+	for _, repo := range r.hostSearchPath() {
+		item, remaining, err := repo.GetItem(append([]string{"hosts"}, args...))
+		if err != nil {
+			continue
+		}
 
-	item, remaining, err := r.GetItem(args)
-	host := item.(HostInfo)
+		used := append(repo.PathKeys(), "hosts")
+		used = append(used, args[:len(args)-len(remaining)]...)
+		return hostCategory(strings.Join(used, " "), item, remaining)
+	}
 
+	return nil, fmt.Errorf("No host could be found for %q", def)
+}
+
+// getQualifiedHost returns hosts from the repository with the given key
+func (r *Repo) getQualifiedHost(key, path string) ([]*Host, error) {
+	repo, ok := findRepo(r.repos, key)
+	if !ok {
+		if root := r.Root(); root.Key == key || root.Alias == key {
+			repo = root
+		} else {
+			return nil, fmt.Errorf("No such repository: %s", key)
+		}
+	}
+
+	args := strings.Fields(path)
+	item, remaining, err := repo.GetItem(args)
 	if err != nil {
-		log.Print(err)
-		log.Fatal("No host could be found")
+		return nil, fmt.Errorf("No host could be found for %q: %s", key+":"+path, err)
+	}
+
+	used := append([]string{repo.Key}, args[:len(args)-len(remaining)]...)
+	return hostCategory(strings.Join(used, " "), item, remaining)
+}
+
+// hostSearchPath returns the repositories to look for hosts in, in order
+func (r *Repo) hostSearchPath() (path []*Repo) {
+	for repo := r; repo != nil; repo = repo.Parent {
+		path = append(path, repo)
+	}
+
+	root := r.Root()
+	for _, key := range repoKeys(r.repos) {
+		if repo := r.repos[key]; repo != root {
+			path = append(path, repo)
+		}
+	}
+	return
+}
+
+// hostCategory returns the hosts of the category given by the remaining
+// arguments of a host item lookup, like "db ro kind:longquery"
+func hostCategory(ref string, item Item, remaining []string) ([]*Host, error) {
+	host, ok := item.(*HostInfo)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a host definition", ref)
+	}
+
+	if len(remaining) == 0 {
+		return nil, fmt.Errorf("%s needs a category; choices are %s", ref, strings.Join(host.Types.List(), ", "))
+	}
+
+	cat, ok := host.Types[remaining[0]]
+	if !ok {
+		return nil, fmt.Errorf(
+			"%s has no category %q; choices are %s",
+			ref, remaining[0], strings.Join(host.Types.List(), ", "),
+		)
+	}
+
+	if len(remaining) > 2 {
+		return nil, fmt.Errorf("Trailing identifiers in host string: %s", strings.Join(remaining[2:], " "))
 	}
 
-	cat := host.Types[remaining[0]]
-	return cat.PrimaryHost()
+	sel := ""
+	if len(remaining) == 2 {
+		sel = remaining[1]
+	}
+
+	hosts, err := cat.SelectAll(sel)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %s", ref, remaining[0], err)
+	}
+	return hosts, nil
 }
 
 // GetItem will return an Info as defined by the list of arguments
@@ -240,13 +480,16 @@ func (r *Repo) GetItem(args []string) (Item, []string, error) {
 
 	repo, remaining, err := r.GetSubrepo(args)
 	if err != nil {
-		log.Print(repo)
 		return nil, []string{}, errors.New(
 			"No matching Info found because no subrepo matched the query.",
 		)
 	}
 
-	if item, ok = repo.Items[remaining[0]]; ok {
+	if len(remaining) == 0 {
+		return nil, []string{}, errors.New("No matching Info found; the query points to a subrepo.")
+	}
+
+	if item, ok = repo.item(remaining[0]); ok {
 		return item, remaining[1:], nil
 	}
 
@@ -264,27 +507,182 @@ func (r *Repo) GetSubrepo(args []string) (*Repo, []string, error) {
 	}
 
 	arg := args[0]
-	if repo, ok := r.Subrepos[arg]; ok {
+	if repo, ok := r.subrepo(arg); ok {
 		return repo.GetSubrepo(args[1:])
 	}
 
-	if _, ok := r.Items[arg]; !ok {
+	if _, ok := r.item(arg); !ok {
 		err = fmt.Errorf("Subrepo did not exist: %s", arg)
 	}
 	return r, args, err
 }
 
-// ParentRepo parses the repo tree upwards until it finds the root repository
-//
-// This is used by things like command execution, where the current repository would be
-// `commands` or a subrepository, but the root is needed for host discovery.
+// item returns the item with the given key or alias
+func (r *Repo) item(name string) (Item, bool) {
+	if item, ok := r.Items[name]; ok {
+		return item, true
+	}
+
+	for _, item := range r.Items {
+		if item.Alias() == name {
+			return item, true
+		}
+	}
+	return nil, false
+}
+
+// subrepo returns the subrepo with the given key or alias
+func (r *Repo) subrepo(name string) (*Repo, bool) {
+	if sub, ok := r.Subrepos[name]; ok {
+		return sub, true
+	}
+
+	for _, sub := range r.Subrepos {
+		if sub.Alias == name {
+			return sub, true
+		}
+	}
+	return nil, false
+}
+
+// findRepo returns the repository with the given key or alias
+func findRepo(repos map[string]*Repo, name string) (*Repo, bool) {
+	if r, ok := repos[name]; ok {
+		return r, true
+	}
+
+	for _, r := range repos {
+		if r.Alias == name {
+			return r, true
+		}
+	}
+	return nil, false
+}
+
+// checkNames makes sure that no two repositories, subrepos or items on the same
+// CLI level share a name or alias, or shadow a builtin command
+func checkNames(repos map[string]*Repo) error {
+	var errs []string
+
+	top := cliNames{}
+	for _, name := range builtinCommands {
+		top[name] = fmt.Sprintf("builtin command %q", name)
+	}
+
+	keys := repoKeys(repos)
+	for _, key := range keys {
+		errs = append(errs, top.add(key, fmt.Sprintf("repository %q", key))...)
+	}
+
+	for _, key := range keys {
+		errs = append(errs, top.add(repos[key].Alias, fmt.Sprintf("repository %q", key))...)
+		errs = append(errs, repos[key].checkNames(key)...)
+	}
+
+	if len(errs) != 0 {
+		return fmt.Errorf("Name collisions found:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// checkNames checks the subrepos and items of a repository for collisions
+func (r *Repo) checkNames(prefix string) (errs []string) {
+	names := cliNames{}
+
+	for _, key := range r.SubrepoKeys() {
+		errs = append(errs, names.add(key, fmt.Sprintf("subrepo %q", prefix+" "+key))...)
+	}
+	for _, key := range r.Keys() {
+		errs = append(errs, names.add(key, fmt.Sprintf("item %q", prefix+" "+key))...)
+	}
+
+	for _, key := range r.SubrepoKeys() {
+		sub := r.Subrepos[key]
+		errs = append(errs, names.add(sub.Alias, fmt.Sprintf("subrepo %q", prefix+" "+key))...)
+		errs = append(errs, sub.checkNames(prefix+" "+key)...)
+	}
+	for _, key := range r.Keys() {
+		errs = append(errs, names.add(r.Items[key].Alias(), fmt.Sprintf("item %q", prefix+" "+key))...)
+	}
+
+	return
+}
+
+// cliNames maps the names used on a CLI level to a description of their owner
+type cliNames map[string]string
+
+// add registers a name, returning an error message if it is already taken
+func (n cliNames) add(name, owner string) []string {
+	if name == "" {
+		return nil
+	}
+
+	if other, ok := n[name]; ok && other != owner {
+		return []string{fmt.Sprintf("%s uses %q, which is taken by %s", owner, name, other)}
+	}
+
+	n[name] = owner
+	return nil
+}
+
+// Walk calls fn with the reference of every item in the repository and its
+// subrepos, in key order
+func (r *Repo) Walk(fn func(ref string, item Item)) {
+	r.walk(r.Key, fn)
+}
+
+func (r *Repo) walk(prefix string, fn func(string, Item)) {
+	for _, key := range r.Keys() {
+		fn(prefix+" "+key, r.Items[key])
+	}
+
+	for _, key := range r.SubrepoKeys() {
+		r.Subrepos[key].walk(prefix+" "+key, fn)
+	}
+}
+
+// eachRepo calls fn for the repository and all of its subrepos
+func (r *Repo) eachRepo(fn func(*Repo)) {
+	fn(r)
+	for _, sub := range r.Subrepos {
+		sub.eachRepo(fn)
+	}
+}
+
+// ParentRepo returns the repository that a subrepo is in. Root repositories
+// are their own parents.
 func (r *Repo) ParentRepo() *Repo {
-	if &r.Parent == nil {
+	if r.Parent == nil {
 		return r
 	}
 	return r.Parent
 }
 
+// Transport returns the transport to run commands on hosts with
+func (r *Repo) Transport() Transport {
+	if r.transport == nil {
+		return systemTransport{}
+	}
+	return r.transport
+}
+
+// Root returns the root repository of the tree the repository is in
+func (r *Repo) Root() *Repo {
+	for r.Parent != nil {
+		r = r.Parent
+	}
+	return r
+}
+
+// PathKeys returns the keys from the root repository down to the repository,
+// which is what the repository is called on the command line
+func (r *Repo) PathKeys() []string {
+	if r.Parent == nil {
+		return []string{r.Key}
+	}
+	return append(r.Parent.PathKeys(), r.Key)
+}
+
 // MakeCLI generates a cli.Command chain based on the repository structure
 func (r *Repo) MakeCLI() (c cli.Command) {
 	c = cli.Command{
@@ -293,6 +691,10 @@ func (r *Repo) MakeCLI() (c cli.Command) {
 		HideHelp: true,
 	}
 
+	if r.Alias != "" {
+		c.Aliases = []string{r.Alias}
+	}
+
 	// Make a list of subcommands to add into the Command.
 	subcommands := make([]cli.Command, 0, len(r.Items)+len(r.Subrepos))
 
@@ -310,7 +712,27 @@ func (r *Repo) MakeCLI() (c cli.Command) {
 			Name:     item.ID(),
 			Usage:    item.Summary(),
 			HideHelp: true,
-			Action:   item.Execute,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "backlinks",
+					Usage: "list the items referring to this one",
+				},
+			},
+			Action: func(c *cli.Context) {
+				if c.Bool("backlinks") {
+					PrintBacklinks(r.repos, item)
+					return
+				}
+				item.Execute(c)
+			},
+		}
+
+		if item.Alias() != "" {
+			sc.Aliases = []string{item.Alias()}
+		}
+
+		if f, ok := item.(itemFlagger); ok {
+			sc.Flags = append(sc.Flags, f.Flags()...)
 		}
 
 		sc.Subcommands = append(sc.Subcommands, item.MakeCLI()...)
@@ -323,15 +745,23 @@ func (r *Repo) MakeCLI() (c cli.Command) {
 	return
 }
 
-func (r *Repo) loadItem(path string) Item {
+func (r *Repo) loadItem(path string, f os.FileInfo, cache *ItemCache) Item {
+	if cache != nil {
+		// Plugin items are described by their plugin when they are loaded,
+		// so they are loaded again if the plugin has been swapped out.
+		if item, ok := cache.Get(r, path, f); ok && !stalePlugin(r, item) {
+			return item
+		}
+	}
+
 	info, err := LoadItem(r, path)
 	if err != nil {
-		log.Println("Failed to load info: ", err)
+		log.Println("Failed to load item: ", err)
+		return nil
 	}
-	return info
-}
 
-// Helper to run git commands inside of a repository
-func (r *Repo) git(args ...string) {
-	git(r.root, args...)
+	if cache != nil {
+		cache.Put(path, f, info)
+	}
+	return info
 }
@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -97,3 +98,205 @@ func TestNewRepoNestsDeepAndDoesNotPutItemsOnTopLevels(t *testing.T) {
 	assert.Equal(len(four.Items), 0)
 	assert.Equal(len(five.Items), 1)
 }
+
+func TestGetItemByAlias(t *testing.T) {
+	assert := assert.New(t)
+	r := NewRepo("test/repos/host_tests/printout")
+
+	item, remaining, err := r.GetItem([]string{"h", "pg", "master"})
+
+	assert.Nil(err)
+	assert.Equal("db", item.ID())
+	assert.Equal([]string{"master"}, remaining)
+}
+
+func TestGetHostByAlias(t *testing.T) {
+	assert := assert.New(t)
+	r := NewRepo("test/repos/host_tests/printout")
+
+	host, err := r.GetHost("pg master")
+
+	assert.Nil(err)
+	assert.Equal("db1.cluster6.company.net", host.FQDN)
+}
+
+func TestMakeCLIRegistersAliases(t *testing.T) {
+	assert := assert.New(t)
+	r := NewRepo("test/repos/host_tests/printout")
+
+	c := r.MakeCLI()
+	hosts := c.Subcommands[0]
+	db := hosts.Subcommands[0]
+
+	assert.Equal([]string{"po"}, c.Aliases)
+	assert.Equal([]string{"h"}, hosts.Aliases)
+	assert.Equal([]string{"pg"}, db.Aliases)
+}
+
+func TestLoadReposDetectsNameCollisions(t *testing.T) {
+	assert := assert.New(t)
+	c := &Config{Repositories: []RepoConfig{
+		{Path: "test/repos/alias_tests/alpha"},
+		{Path: "test/repos/alias_tests/beta"},
+	}}
+
+	repos, err := LoadRepos(c)
+
+	assert.Equal(2, len(repos))
+	assert.NotNil(err)
+	assert.Contains(err.Error(), `repository "alpha" uses "beta", which is taken by repository "beta"`)
+	assert.Contains(err.Error(), `item "alpha one" uses "two", which is taken by item "alpha two"`)
+}
+
+func TestLoadReposAcceptsUniqueAliases(t *testing.T) {
+	assert := assert.New(t)
+	c := &Config{Repositories: []RepoConfig{{Path: "test/repos/host_tests/printout"}}}
+
+	_, err := LoadRepos(c)
+
+	assert.Nil(err)
+}
+
+func TestLoadReposDetectsKeyCollisions(t *testing.T) {
+	assert := assert.New(t)
+	c := &Config{Repositories: []RepoConfig{
+		{Path: "test/repos/key_tests/one/topic"},
+		{Path: "test/repos/key_tests/two/topic"},
+	}}
+
+	repos, err := LoadRepos(c)
+
+	assert.Equal(1, len(repos))
+	assert.True(strings.HasSuffix(repos["topic"].root, "one/topic"))
+	assert.NotNil(err)
+	assert.Contains(err.Error(), `both use the key "topic"`)
+}
+
+func TestLoadReposNamespacesKeys(t *testing.T) {
+	assert := assert.New(t)
+	c := &Config{Repositories: []RepoConfig{
+		{Path: "test/repos/key_tests/one/topic"},
+		{Path: "test/repos/key_tests/two/topic", Namespace: "two"},
+		{Path: "test/repos/key_tests/two/topic", Key: "again"},
+	}}
+
+	repos, err := LoadRepos(c)
+
+	assert.Nil(err)
+	assert.Equal([]string{"again", "topic", "two/topic"}, repoKeys(repos))
+}
+
+// testParentRepos loads the shop and infra repositories
+func testParentRepos() map[string]*Repo {
+	c := &Config{Repositories: []RepoConfig{
+		{Path: "test/repos/parent_tests/shop"},
+		{Path: "test/repos/parent_tests/infra"},
+	}}
+
+	repos, _ := LoadRepos(c)
+	return repos
+}
+
+// testCommandHost resolves the host of the single target of a command
+func testCommandHost(repos map[string]*Repo, ref string) (*Host, error) {
+	item, err := ResolveRef(repos, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	c := item.(*Command)
+	for _, def := range c.Hosts {
+		return c.repo.GetHost(def)
+	}
+	return nil, nil
+}
+
+func TestSubreposKnowTheirParents(t *testing.T) {
+	assert := assert.New(t)
+	shop := testParentRepos()["shop"]
+
+	ops := shop.Subrepos["ops"]
+	web := ops.Subrepos["deploy"].Subrepos["web"]
+
+	assert.Nil(shop.Parent)
+	assert.Equal(shop, ops.Parent)
+	assert.Equal(ops, web.Parent.ParentRepo())
+	assert.Equal(shop, shop.ParentRepo())
+	assert.Equal(shop, web.Root())
+	assert.Equal([]string{"shop", "ops", "deploy", "web"}, web.PathKeys())
+	assert.Equal([]string{"shop"}, shop.PathKeys())
+}
+
+func TestDeepCommandsFindHostsOfTheirAncestors(t *testing.T) {
+	assert := assert.New(t)
+	repos := testParentRepos()
+
+	host, err := testCommandHost(repos, "shop ops deploy web restart")
+
+	assert.Nil(err)
+	assert.Equal("shop-db1.example.com", host.FQDN)
+}
+
+func TestCommandsPreferTheClosestHosts(t *testing.T) {
+	assert := assert.New(t)
+	repos := testParentRepos()
+
+	host, err := testCommandHost(repos, "shop ops staging deploy migrate")
+
+	assert.Nil(err)
+	assert.Equal("staging-db1.example.com", host.FQDN)
+}
+
+func TestCommandsFallBackToHostsOfOtherRepos(t *testing.T) {
+	assert := assert.New(t)
+	repos := testParentRepos()
+
+	host, err := testCommandHost(repos, "shop ops cache flush")
+
+	assert.Nil(err)
+	assert.Equal("cache1.example.com", host.FQDN)
+}
+
+func TestGetHostReportsMissingHosts(t *testing.T) {
+	assert := assert.New(t)
+	web := testParentRepos()["shop"].Subrepos["ops"].Subrepos["deploy"].Subrepos["web"]
+
+	_, err := web.GetHost("queue primary")
+	assert.EqualError(err, `No host could be found for "queue primary"`)
+
+	_, err = web.GetHost("db replica")
+	assert.EqualError(err, `shop hosts db has no category "replica"; choices are master`)
+
+	_, err = web.GetHost("db")
+	assert.NotNil(err)
+}
+
+func TestCommandsFindHostsOfNamedRepos(t *testing.T) {
+	assert := assert.New(t)
+	repos := testParentRepos()
+
+	host, err := testCommandHost(repos, "shop ops backup")
+
+	assert.Nil(err)
+	assert.Equal("infra-db1.example.com", host.FQDN)
+}
+
+func TestGetHostReportsMissingNamedRepos(t *testing.T) {
+	assert := assert.New(t)
+	shop := testParentRepos()["shop"]
+
+	_, err := shop.GetHost("nowhere:hosts db master")
+	assert.EqualError(err, "No such repository: nowhere")
+
+	_, err = shop.GetHost("infra:hosts db replica")
+	assert.EqualError(err, `infra hosts db has no category "replica"; choices are master`)
+}
+
+func TestRepoName(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("topic", repoName("https://github.com/team/saga-topic.git"))
+	assert.Equal("topic", repoName("git@github.com:team/kb-topic.git"))
+	assert.Equal("topic", repoName("git@github.com:team-name/topic"))
+	assert.Equal("topic", repoName("/srv/git/topic/"))
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/codegangsta/cli"
+	"os"
+	"strings"
+)
+
+// The risk levels of commands, from the least to the most risky
+const (
+	RiskReadOnly    = "read-only"
+	RiskSafe        = "safe"
+	RiskDisruptive  = "disruptive"
+	RiskDestructive = "destructive"
+)
+
+var risks = []string{RiskReadOnly, RiskSafe, RiskDisruptive, RiskDestructive}
+
+// The risk of commands that do not declare one, and the highest risk that
+// --yes confirms unless the configuration says otherwise
+const (
+	defaultRisk    = RiskDisruptive
+	defaultYesRisk = RiskSafe
+)
+
+// errDeclined is returned when the user answers no
+var errDeclined = errors.New("declined")
+
+// yesFlag confirms running a command without being asked
+var yesFlag = cli.BoolFlag{
+	Name:  "yes, y",
+	Usage: "do not ask before running the command, if its risk allows it",
+}
+
+// approvalFlag gives the approved request to run a command that needs approval
+var approvalFlag = cli.StringFlag{
+	Name:  "approval",
+	Usage: "run with the request in this file, approved with `sp approve`",
+}
+
+// stdinIsTerminal tells if there is someone to ask for confirmation
+var stdinIsTerminal = func() bool {
+	fi, err := os.Stdin.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// readAnswer asks a question and returns the answer, without surrounding
+// whitespace
+var readAnswer = func(prompt string) string {
+	fmt.Print(prompt)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	return strings.TrimSpace(answer)
+}
+
+// riskLevel returns how risky a risk is, as its position in the list of risks
+func riskLevel(risk string) (int, error) {
+	for x, r := range risks {
+		if r == risk {
+			return x, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown risk %q; choices are %s", risk, strings.Join(risks, ", "))
+}
+
+// riskOr returns a declared risk, or the default one if none is declared
+func riskOr(raw string) string {
+	if raw == "" {
+		return defaultRisk
+	}
+	return raw
+}
+
+// Risk returns the risk of the command
+func (c *Command) Risk() string {
+	return riskOr(c.RawRisk)
+}
+
+// confirm asks whether to run the command on the hosts of a target, as its
+// risk demands, see confirmRisk
+func (c *Command) confirm(target string, hosts []*Host, yes bool) error {
+	return confirmRisk(c.repo, "command", c.Risk(), c.Defaults(), target, hosts, yes)
+}
+
+// confirmRisk asks whether to run `what`, a command or transfer, on the hosts of
+// a target as its risk demands, returning errDeclined if the answer is no
+func confirmRisk(r *Repo, what, risk string, defaults Defaults, target string, hosts []*Host, yes bool) error {
+	level, err := riskLevel(risk)
+	if err != nil {
+		return err
+	}
+
+	yesRisk := r.yesRisk
+	if yesRisk == "" {
+		yesRisk = defaultYesRisk
+	}
+	yesLevel, err := riskLevel(yesRisk)
+	if err != nil {
+		return fmt.Errorf("yes_risk in the configuration: %s", err)
+	}
+
+	destructive, _ := riskLevel(RiskDestructive)
+	switch {
+	case risk == RiskReadOnly:
+		return nil
+	case yes && level <= yesLevel:
+		return nil
+	case level < destructive && !defaults.Confirms():
+		return nil
+	}
+
+	if !stdinIsTerminal() {
+		return fmt.Errorf(
+			"The %s is %s, and stdin is not a terminal to ask for confirmation on; --yes confirms %ss up to %s",
+			what, risk, what, yesRisk,
+		)
+	}
+
+	if level == destructive {
+		name := target
+		if len(hosts) != 0 && hosts[0].Category() != "" {
+			name = hosts[0].Category()
+		}
+
+		if readAnswer(fmt.Sprintf("This %s is destructive. Type %q to continue: ", what, name)) != name {
+			return errDeclined
+		}
+		fmt.Println()
+		return nil
+	}
+
+	if !strings.HasPrefix(strings.ToLower(readAnswer("Do you want to continue? [y/N] ")), "y") {
+		return errDeclined
+	}
+	fmt.Println()
+	return nil
+}
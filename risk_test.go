@@ -0,0 +1,113 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// testConfirm answers prompts with `answer` on a terminal, or runs without a
+// terminal if it is nil. The prompts asked are recorded.
+func testConfirm(answer *string) (*[]string, func()) {
+	var prompts []string
+
+	oldTerminal, oldAnswer := stdinIsTerminal, readAnswer
+	stdinIsTerminal = func() bool { return answer != nil }
+	readAnswer = func(prompt string) string {
+		prompts = append(prompts, prompt)
+		return *answer
+	}
+
+	return &prompts, func() {
+		stdinIsTerminal, readAnswer = oldTerminal, oldAnswer
+	}
+}
+
+func TestCommandRisk(t *testing.T) {
+	assert := assert.New(t)
+	repos := testParentRepos()
+
+	item, _ := ResolveRef(repos, "shop ops failover")
+	assert.Equal(RiskDestructive, item.(*Command).Risk())
+
+	item, _ = ResolveRef(repos, "shop ops healthcheck")
+	assert.Equal(RiskReadOnly, item.(*Command).Risk())
+
+	item, _ = ResolveRef(repos, "shop ops backup")
+	assert.Equal(RiskDisruptive, item.(*Command).Risk())
+
+	_, err := riskLevel("harmless")
+	assert.EqualError(err, `Unknown risk "harmless"; choices are read-only, safe, disruptive, destructive`)
+}
+
+func TestConfirmByRisk(t *testing.T) {
+	assert := assert.New(t)
+
+	no, yes := "n", "y"
+	prompts, restore := testConfirm(&no)
+	defer restore()
+
+	c := &Command{RawRisk: RiskReadOnly, repo: &Repo{}}
+	assert.Nil(c.confirm("db", nil, false))
+	assert.Empty(*prompts)
+
+	c.RawRisk = RiskSafe
+	assert.Equal(errDeclined, c.confirm("db", nil, false))
+	assert.Nil(c.confirm("db", nil, true))
+	assert.Equal(1, len(*prompts))
+
+	// --yes only goes up to safe by default
+	c.RawRisk = RiskDisruptive
+	assert.Equal(errDeclined, c.confirm("db", nil, true))
+	assert.Equal("Do you want to continue? [y/N] ", (*prompts)[1])
+
+	c.repo.yesRisk = RiskDisruptive
+	assert.Nil(c.confirm("db", nil, true))
+
+	_, restore = testConfirm(&yes)
+	assert.Nil(c.confirm("db", nil, false))
+	restore()
+
+	c.repo.yesRisk = "everything"
+	assert.Contains(c.confirm("db", nil, true).Error(), "yes_risk in the configuration")
+}
+
+func TestConfirmDestructive(t *testing.T) {
+	assert := assert.New(t)
+
+	item, _ := ResolveRef(testParentRepos(), "shop ops failover")
+	c := item.(*Command)
+	hosts, _ := c.repo.GetHosts(c.Hosts["db"])
+
+	answer := "yes"
+	prompts, restore := testConfirm(&answer)
+	defer restore()
+
+	// Only typing the category will do, even when confirming is turned off
+	off := false
+	c.Confirm = &off
+	assert.Equal(errDeclined, c.confirm("db", hosts, true))
+	assert.Equal(`This command is destructive. Type "master" to continue: `, (*prompts)[0])
+
+	answer = "master"
+	assert.Nil(c.confirm("db", hosts, false))
+
+	c.repo.yesRisk = RiskDestructive
+	answer = ""
+	assert.Nil(c.confirm("db", hosts, true))
+	assert.Equal(2, len(*prompts))
+}
+
+func TestConfirmWithoutTerminal(t *testing.T) {
+	assert := assert.New(t)
+
+	prompts, restore := testConfirm(nil)
+	defer restore()
+
+	c := &Command{RawRisk: RiskDisruptive, repo: &Repo{}}
+	err := c.confirm("db", nil, true)
+	assert.EqualError(err, "The command is disruptive, and stdin is not a terminal to ask for confirmation on; --yes confirms commands up to safe")
+	assert.Empty(*prompts)
+
+	c.RawRisk = RiskSafe
+	assert.Nil(c.confirm("db", nil, true))
+}
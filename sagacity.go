@@ -1,6 +1,7 @@
 package main
 
 import (
+	"log"
 	"os"
 	"os/user"
 	"path/filepath"
@@ -11,7 +12,16 @@ func main() {
 	fn := filepath.Join(u.HomeDir, ".config", "sagacity", "sagacity.yaml")
 	conf := LoadConfig(fn)
 
-	repos := LoadRepos(conf)
+	// Collisions are only warned about, so that `sp repo` can still be used
+	// to fix them
+	repos, err := LoadRepos(conf)
+	if repos == nil {
+		log.Fatal(err)
+	}
+	if err != nil {
+		log.Println(err)
+	}
+
 	app := BuildCLI(repos, conf)
 	app.Run(os.Args)
 }
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// SignaturePolicy requires the commits of a repository to be signed by one of
+// a list of trusted keys before they are merged or run
+type SignaturePolicy struct {
+	// Keys are SSH public keys in authorized_keys format, or fingerprints of
+	// GPG keys. GPG keys also need to be in the keyring of the user.
+	Keys []string `yaml:"keys"`
+}
+
+// signatureProblems explains the signature statuses of `git log --format=%G?`
+// that are not good signatures
+var signatureProblems = map[string]string{
+	"N": "is not signed",
+	"B": "has a bad signature",
+	"X": "has a signature that has expired",
+	"Y": "has a signature made by a key that has expired",
+	"R": "has a signature made by a key that has been revoked",
+	"E": "has a signature that cannot be checked; is the key missing?",
+}
+
+// VerifyCommit checks that a commit in the git repository on a path is signed
+// by one of the trusted keys
+func (p *SignaturePolicy) VerifyCommit(path, commit string) error {
+	// git needs an allowed signers file to check SSH signatures at all. The
+	// principal is not checked; the fingerprints are compared below instead.
+	f, err := ioutil.TempFile("", "sagacity-allowed-signers")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	for _, key := range p.sshKeys() {
+		fmt.Fprintf(f, "* %s\n", key)
+	}
+	f.Close()
+
+	out, err := gitOutput(
+		path, "-c", "gpg.ssh.allowedSignersFile="+f.Name(),
+		"log", "-1", "--format=%G?%n%GF%n%GP", commit,
+	)
+	if err != nil {
+		return err
+	}
+
+	lines := strings.Split(out, "\n")
+	status := lines[0]
+	if problem, ok := signatureProblems[status]; ok {
+		return fmt.Errorf("Commit %.7s %s", commit, problem)
+	}
+
+	// What is left is G and U, good signatures that only differ in how much
+	// the keyring trusts the key. Trust is given by the list of keys instead.
+	trusted := p.fingerprints()
+	for _, fpr := range lines[1:] {
+		if fpr != "" && trusted[normalizeFingerprint(fpr)] {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Commit %.7s is signed by an untrusted key: %s", commit, lines[1])
+}
+
+// sshKeys returns the keys of the policy that are SSH public keys
+func (p *SignaturePolicy) sshKeys() (keys []string) {
+	for _, key := range p.Keys {
+		if len(strings.Fields(key)) > 1 {
+			keys = append(keys, key)
+		}
+	}
+	return
+}
+
+// fingerprints returns the normalized fingerprints of all the trusted keys
+func (p *SignaturePolicy) fingerprints() map[string]bool {
+	fprs := make(map[string]bool)
+	for _, key := range p.Keys {
+		fields := strings.Fields(key)
+		if len(fields) == 1 {
+			fprs[normalizeFingerprint(key)] = true
+			continue
+		}
+
+		// An SSH public key; its fingerprint is the base64 encoded SHA256
+		// hash of the key blob, which is what git reports.
+		blob, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			continue
+		}
+		sum := sha256.Sum256(blob)
+		fprs["SHA256:"+base64.RawStdEncoding.EncodeToString(sum[:])] = true
+	}
+	return fprs
+}
+
+// normalizeFingerprint makes GPG fingerprints comparable regardless of how
+// they are written. SSH fingerprints are case sensitive and left alone.
+func normalizeFingerprint(fpr string) string {
+	if strings.HasPrefix(fpr, "SHA256:") {
+		return fpr
+	}
+	return strings.ToUpper(strings.Replace(fpr, " ", "", -1))
+}
+
+// VerifyCheckout checks the checked out commit of a repository, and that it has
+// no local modifications, against its signature policy
+func (rc RepoConfig) VerifyCheckout() error {
+	if rc.Verify == nil {
+		return nil
+	}
+
+	if rc.Type != GitRepo {
+		return fmt.Errorf("%s is not a git repository and cannot be verified", rc.Path)
+	}
+
+	st, err := GitStatus(rc.Path)
+	if err != nil {
+		return err
+	}
+	if st.Dirty {
+		return errors.New("The repository has local modifications")
+	}
+
+	return rc.Verify.VerifyCommit(rc.Path, "HEAD")
+}
+
+// verifiedCheckouts are the results of verifyCheckoutOnce, by path
+var verifiedCheckouts sync.Map
+
+// verifyCheckoutOnce is VerifyCheckout, done once per repository and run rather
+// than for every plugin item
+func verifyCheckoutOnce(rc RepoConfig) error {
+	if rc.Verify == nil {
+		return nil
+	}
+
+	if v, ok := verifiedCheckouts.Load(rc.Path); ok {
+		err, _ := v.(error)
+		return err
+	}
+	err := rc.VerifyCheckout()
+	verifiedCheckouts.Store(rc.Path, err)
+	return err
+}
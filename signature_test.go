@@ -0,0 +1,102 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testSSHKey generates an SSH key pair in dir, returning the path of the
+// private key and the public key itself
+func testSSHKey(t *testing.T, dir, name string) (string, string) {
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("ssh-keygen is not installed")
+	}
+
+	key := filepath.Join(dir, name)
+	out, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", name, "-f", key).CombinedOutput()
+	if err != nil {
+		t.Fatalf("ssh-keygen failed: %s\n%s", err, out)
+	}
+
+	pub, _ := ioutil.ReadFile(key + ".pub")
+	return key, strings.TrimSpace(string(pub))
+}
+
+// testSignedCommit makes a commit in dir signed by an SSH key
+func testSignedCommit(t *testing.T, dir, key, file string) {
+	ioutil.WriteFile(filepath.Join(dir, file), []byte("type: info\n"), 0644)
+	testGit(t, dir, "add", ".")
+	testGit(t, dir, "-c", "gpg.format=ssh", "-c", "user.signingkey="+key, "commit", "-q", "-S", "-m", "signed "+file)
+}
+
+func TestVerifyCommit(t *testing.T) {
+	assert := assert.New(t)
+	upstream, _, cleanup := testClone(t)
+	defer cleanup()
+
+	trustedKey, trusted := testSSHKey(t, filepath.Dir(upstream), "trusted")
+	otherKey, _ := testSSHKey(t, filepath.Dir(upstream), "other")
+	policy := &SignaturePolicy{Keys: []string{trusted}}
+
+	err := policy.VerifyCommit(upstream, "HEAD")
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "is not signed")
+
+	testSignedCommit(t, upstream, trustedKey, "trusted.yaml")
+	assert.Nil(policy.VerifyCommit(upstream, "HEAD"))
+
+	testSignedCommit(t, upstream, otherKey, "other.yaml")
+	err = policy.VerifyCommit(upstream, "HEAD")
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "untrusted key")
+
+	// Trusting by fingerprint works as well
+	fpr, _ := exec.Command("ssh-keygen", "-l", "-f", otherKey+".pub").Output()
+	policy = &SignaturePolicy{Keys: []string{strings.Fields(string(fpr))[1]}}
+	assert.Nil(policy.VerifyCommit(upstream, "HEAD"))
+}
+
+func TestUpdateReposRefusesUnverifiedCommits(t *testing.T) {
+	assert := assert.New(t)
+	upstream, clone, cleanup := testClone(t)
+	defer cleanup()
+
+	key, pub := testSSHKey(t, filepath.Dir(upstream), "trusted")
+	c := &Config{Repositories: []RepoConfig{{
+		Path:   clone,
+		Verify: &SignaturePolicy{Keys: []string{pub}},
+	}}}
+
+	testSignedCommit(t, upstream, key, "signed.yaml")
+	results := UpdateRepos(c, nil, UpdateOptions{})
+	assert.Equal(Updated, results[0].Status)
+	assert.Nil(c.Repositories[0].VerifyCheckout())
+
+	before, _ := gitOutput(clone, "rev-parse", "HEAD")
+	testCommit(t, upstream, "unsigned.yaml", "type: info\n")
+	results = UpdateRepos(c, nil, UpdateOptions{})
+	after, _ := gitOutput(clone, "rev-parse", "HEAD")
+
+	assert.Equal(Unverified, results[0].Status)
+	assert.Equal(before, after)
+}
+
+func TestVerifyCheckout(t *testing.T) {
+	assert := assert.New(t)
+	upstream, clone, cleanup := testClone(t)
+	defer cleanup()
+
+	_, pub := testSSHKey(t, filepath.Dir(upstream), "trusted")
+
+	assert.Nil(RepoConfig{Path: clone}.VerifyCheckout())
+
+	rc := RepoConfig{Path: clone, Verify: &SignaturePolicy{Keys: []string{pub}}}
+	assert.NotNil(rc.VerifyCheckout())
+
+	rc = RepoConfig{Path: "test/repos/ref_tests/wiki", Type: LocalRepo, Verify: rc.Verify}
+	assert.NotNil(rc.VerifyCheckout())
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/codegangsta/cli"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// tmuxFlags are the flags of host items and their categories for opening
+// every host at once
+var tmuxFlags = []cli.Flag{
+	cli.BoolFlag{
+		Name:  "all, tmux",
+		Usage: "open every host of the categories in a tmux window",
+	},
+	cli.BoolFlag{
+		Name:  "sync",
+		Usage: "with --all, send the input to all of the panes",
+	},
+}
+
+// tmuxMode tells if --all was given on the command line, either to the
+// command itself or to one of its parents
+func tmuxMode(c *cli.Context) (all, sync bool) {
+	all = c.Bool("all") || c.GlobalBool("all")
+	sync = c.Bool("sync") || c.GlobalBool("sync")
+	return
+}
+
+// runTmux runs a tmux command and returns its output
+var runTmux = func(args ...string) (string, error) {
+	out, err := exec.Command("tmux", args...).Output()
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok && len(ee.Stderr) != 0 {
+			return "", fmt.Errorf("tmux %s: %s", args[0], strings.TrimSpace(string(ee.Stderr)))
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// OpenTmux opens a ssh session to every host in a new tmux window, with one
+// tiled pane per host. If `sync` is set, what is typed goes to every pane.
+func OpenTmux(name string, hosts []*Host, sync bool) error {
+	if os.Getenv("TMUX") == "" {
+		return errors.New("Not inside tmux; --all opens the hosts in panes of the current tmux session")
+	}
+
+	if len(hosts) == 0 {
+		return errors.New("No hosts to open")
+	}
+
+	window, err := runTmux("new-window", "-P", "-F", "#{window_id}", "-n", name, shellJoin(hosts[0].Command()))
+	if err != nil {
+		return err
+	}
+
+	for _, host := range hosts[1:] {
+		if _, err := runTmux("split-window", "-t", window, shellJoin(host.Command())); err != nil {
+			return err
+		}
+
+		// Tile after every split, or tmux runs out of room for new panes.
+		if _, err := runTmux("select-layout", "-t", window, "tiled"); err != nil {
+			return err
+		}
+	}
+
+	if sync {
+		if _, err := runTmux("set-window-option", "-t", window, "synchronize-panes", "on"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// shellJoin quotes arguments for a shell, like tmux runs its commands with
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for x, arg := range args {
+		if arg != "" && strings.Trim(arg, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_.,:/=@+%") == "" {
+			quoted[x] = arg
+			continue
+		}
+		quoted[x] = "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+// testTmux records the tmux commands that are run instead of running them
+func testTmux(t *testing.T) (*[]string, func()) {
+	var calls []string
+	orig := runTmux
+
+	t.Setenv("TMUX", "/tmp/tmux-1000/default,1234,0")
+	runTmux = func(args ...string) (string, error) {
+		calls = append(calls, strings.Join(args, " "))
+		if args[0] == "new-window" {
+			return "@7", nil
+		}
+		return "", nil
+	}
+
+	return &calls, func() {
+		runTmux = orig
+	}
+}
+
+func TestOpenTmux(t *testing.T) {
+	assert := assert.New(t)
+	calls, cleanup := testTmux(t)
+	defer cleanup()
+
+	hosts := []*Host{
+		{FQDN: "db1"},
+		{FQDN: "db2", SSH: SSHSettings{User: "o'brien"}},
+	}
+
+	assert.Nil(OpenTmux("db ro", hosts, true))
+	assert.Equal([]string{
+		"new-window -P -F #{window_id} -n db ro ssh db1 -A -t",
+		`split-window -t @7 ssh -l 'o'\''brien' db2 -A -t`,
+		"select-layout -t @7 tiled",
+		"set-window-option -t @7 synchronize-panes on",
+	}, *calls)
+}
+
+func TestOpenTmuxNeedsTmux(t *testing.T) {
+	assert := assert.New(t)
+	calls, cleanup := testTmux(t)
+	defer cleanup()
+	t.Setenv("TMUX", "")
+
+	err := OpenTmux("db ro", []*Host{{FQDN: "db1"}}, false)
+
+	assert.Contains(err.Error(), "Not inside tmux")
+	assert.Equal(0, len(*calls))
+}
+
+func TestAllOpensEveryHostOfTheCategories(t *testing.T) {
+	assert := assert.New(t)
+	repos, _ := LoadRepos(&Config{Repositories: []RepoConfig{{Path: "test/repos/host_tests/printout"}}})
+	app := BuildCLI(repos, &Config{})
+
+	for _, args := range [][]string{
+		{"printout", "hosts", "db", "--all", "standby", "wal"},
+		{"printout", "hosts", "db", "standby", "--tmux", "wal"},
+	} {
+		calls, cleanup := testTmux(t)
+		app.Run(append([]string{"sagacity"}, args...))
+		cleanup()
+
+		assert.Equal(5, len(*calls), args)
+		assert.Contains((*calls)[0], "-n db standby,wal ssh db8.cluster3.company.net")
+		assert.Contains((*calls)[1], "ssh db1.cluster3.company.net")
+		assert.Contains((*calls)[3], "ssh db7.cluster3.company.net")
+	}
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/codegangsta/cli"
+	"github.com/fatih/color"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func init() {
+	RegisterItemType("transfer", ItemType{
+		New: func() Item { return &Transfer{} },
+	})
+}
+
+// The directions of a transfer
+const (
+	Push = "push"
+	Pull = "pull"
+)
+
+// Transfer is a file that is pushed to or pulled from hosts. Local paths are
+// relative to the directory of the item.
+type Transfer struct {
+	RawType     string            `yaml:"type"`
+	RawSummary  string            `yaml:"summary"`
+	RawAlias    string            `yaml:"alias"`
+	Direction   string            `yaml:"direction"` // push (the default) or pull
+	Source      string            `yaml:"source"`
+	Destination string            `yaml:"destination"`
+	Hosts       map[string]string `yaml:"hosts"`
+	Mode        string            `yaml:"mode"`     // octal, like "0644"
+	Checksum    bool              `yaml:"checksum"` // compare SHA256 sums after copying
+	Tool        string            `yaml:"tool"`     // scp (the default) or rsync
+	Confirm     *bool             `yaml:"confirm"`
+	RawRisk     string            `yaml:"risk"`
+	SeeAlso     []string          `yaml:"see_also"`
+
+	// Windows and Freezes limit when the transfer can run, like the ones of
+	// commands
+	Windows []Window `yaml:"windows"`
+	Freezes []Freeze `yaml:"freezes"`
+
+	id   string
+	path string
+	repo *Repo
+}
+
+// TransferResult is the outcome of a transfer to or from one host
+type TransferResult struct {
+	Host   string
+	Failed bool
+	Detail string
+}
+
+// runTransfer runs the commands of a transfer and returns their output
+var runTransfer = func(name string, args ...string) (string, error) {
+	var out strings.Builder
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s failed: %s", name, err)
+	}
+	return out.String(), nil
+}
+
+func (t Transfer) String() string {
+	return fmt.Sprintf("X: %s", t.ID())
+}
+
+// Execute copies the file to or from the hosts of the target given as the
+// first argument, or lists the targets if there is none
+func (t *Transfer) Execute(cl *cli.Context) {
+	yellow := color.New(color.FgYellow, color.Bold).SprintfFunc()
+	green := color.New(color.FgGreen, color.Bold).SprintfFunc()
+
+	args := cl.Args()
+	if len(args) == 0 {
+		fmt.Println("Specify host targets:")
+		for _, key := range commandHostKey(t.Hosts) {
+			fmt.Printf("  %s: %s\n", green(key), yellow(t.Hosts[key]))
+		}
+		printSeeAlso(t.repo.repos, t.SeeAlso)
+		return
+	}
+
+	t.run(args[0], runOptionsFrom(cl))
+}
+
+// Flags returns the flags of the transfer of the item
+func (t Transfer) Flags() []cli.Flag {
+	return []cli.Flag{yesFlag, overrideFlag}
+}
+
+// Risk returns the risk of the transfer
+func (t *Transfer) Risk() string {
+	return riskOr(t.RawRisk)
+}
+
+// Guard returns why the transfer is not allowed to run at a time, if it is
+// not, see guard
+func (t *Transfer) Guard(now time.Time) error {
+	return guard(t.repo, t.Risk(), t.Windows, t.Freezes, now)
+}
+
+// Ref returns the reference to the transfer, like `shop ops nginx`
+func (t *Transfer) Ref() string {
+	return strings.Join(append(t.repo.PathKeys(), t.id), " ")
+}
+
+// run runs the transfer for the host target with the given key
+func (t *Transfer) run(target string, opts runOptions) {
+	blue := color.New(color.FgBlue, color.Bold).SprintfFunc()
+	magenta := color.New(color.FgMagenta, color.Bold).SprintfFunc()
+	yellow := color.New(color.FgYellow, color.Bold).SprintfFunc()
+	green := color.New(color.FgGreen, color.Bold).SprintfFunc()
+
+	hostdef, ok := t.Hosts[target]
+	if !ok {
+		log.Fatalf("No such host target: %s", target)
+	}
+
+	if err := t.repo.config.VerifyCheckout(); err != nil {
+		log.Fatal("Refusing to transfer files from an unverified repository: ", err)
+	}
+
+	hosts, err := t.repo.GetHosts(hostdef)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	verb := "Pushes"
+	if t.direction() == Pull {
+		verb = "Pulls"
+	}
+
+	fmt.Printf(
+		"%s: %s\n%s %s to %s on %d hosts matching %s (%s)\n\n",
+		blue(t.ID()), magenta(t.Summary()),
+		verb, yellow(t.Source), yellow(t.Destination),
+		len(hosts), green(hostdef), t.Risk(),
+	)
+
+	entry := HistoryEntry{
+		Time:    time.Now(),
+		User:    currentUser(),
+		Item:    t.Ref(),
+		Target:  target,
+		Command: fmt.Sprintf("%s %s %s", t.direction(), t.Source, t.Destination),
+	}
+
+	if err := t.Guard(entry.Time); err != nil {
+		if opts.override == "" {
+			log.Fatal(err, ". Use --override <reason> to run it anyway.")
+		}
+		fmt.Printf("%s, but it is overridden: %s\n\n", err, opts.override)
+		entry.Override = opts.override
+	}
+
+	defaults := t.repo.defaults.Merge(Defaults{Confirm: t.Confirm})
+	if err := confirmRisk(t.repo, "transfer", t.Risk(), defaults, target, hosts, opts.yes); err == errDeclined {
+		fmt.Println("Doing nothing.")
+
+		entry.Declined = true
+		recordRun(entry)
+		os.Exit(1)
+	} else if err != nil {
+		log.Fatal(err)
+	}
+
+	results := t.Transfer(hosts)
+	for _, r := range results {
+		status := StatusOK
+		if r.Failed {
+			status = StatusFailed
+		}
+		entry.Results = append(entry.Results, CommandResult{Host: r.Host, Status: status, Attempts: 1, Detail: r.Detail})
+	}
+	recordRun(entry)
+
+	if !PrintTransferResults(results) {
+		os.Exit(1)
+	}
+}
+
+// Transfer copies the file to or from each of the hosts in turn
+func (t *Transfer) Transfer(hosts []*Host) []TransferResult {
+	results := make([]TransferResult, 0, len(hosts))
+	for _, host := range hosts {
+		result := TransferResult{Host: host.FQDN, Detail: "ok"}
+
+		var err error
+		if t.direction() == Pull {
+			err = t.pull(host, len(hosts) > 1)
+		} else {
+			err = t.push(host)
+		}
+
+		if err != nil {
+			result.Failed = true
+			result.Detail = err.Error()
+		} else if t.Checksum {
+			result.Detail = "ok, checksum verified"
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// push copies the local source to the destination on a host
+func (t *Transfer) push(host *Host) error {
+	if _, err := t.mode(); err != nil {
+		return err
+	}
+
+	src := t.localPath(t.Source)
+	if err := t.copy(host, src, remotePath(host, t.Destination)); err != nil {
+		return err
+	}
+
+	if t.Mode != "" {
+		if _, err := runTransfer("ssh", sshCommand(host, "chmod", t.Mode, t.Destination)...); err != nil {
+			return err
+		}
+	}
+
+	if t.Checksum {
+		return verifyChecksum(host, src, t.Destination)
+	}
+	return nil
+}
+
+// pull copies the source on a host to the local destination. When pulling
+// from several hosts, the destination is a directory with a file per host.
+func (t *Transfer) pull(host *Host, many bool) error {
+	mode, err := t.mode()
+	if err != nil {
+		return err
+	}
+
+	dest := t.localPath(t.Destination)
+	if many {
+		dest = filepath.Join(dest, host.FQDN)
+	}
+	os.MkdirAll(filepath.Dir(dest), 0755)
+
+	if err := t.copy(host, remotePath(host, t.Source), dest); err != nil {
+		return err
+	}
+
+	if t.Mode != "" {
+		if err := os.Chmod(dest, mode); err != nil {
+			return err
+		}
+	}
+
+	if t.Checksum {
+		return verifyChecksum(host, dest, t.Source)
+	}
+	return nil
+}
+
+// copy copies a file with scp or rsync, using the SSH settings of the host
+func (t *Transfer) copy(host *Host, src, dest string) error {
+	settings := host.Settings()
+
+	var err error
+	switch t.Tool {
+	case "", "scp":
+		args := []string{"-q"}
+		if settings.Port != 0 {
+			args = append(args, "-P", strconv.Itoa(settings.Port))
+		}
+		if settings.Identity != "" {
+			args = append(args, "-i", settings.Identity)
+		}
+		if settings.ProxyJump != "" {
+			args = append(args, "-J", settings.ProxyJump)
+		}
+		for _, opt := range settings.Options {
+			args = append(args, "-o", opt)
+		}
+		_, err = runTransfer("scp", append(args, src, dest)...)
+
+	case "rsync":
+		ssh := shellJoin(append([]string{"ssh"}, settings.Args()...))
+		_, err = runTransfer("rsync", "-t", "-e", ssh, src, dest)
+
+	default:
+		return fmt.Errorf("Unknown transfer tool %q; use scp or rsync", t.Tool)
+	}
+	return err
+}
+
+// verifyChecksum compares the SHA256 sum of a local file with that of a file
+// on a host
+func verifyChecksum(host *Host, local, remote string) error {
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	want := hex.EncodeToString(h.Sum(nil))
+
+	out, err := runTransfer("ssh", sshCommand(host, "sha256sum", remote)...)
+	if err != nil {
+		return err
+	}
+
+	fields := strings.Fields(out)
+	if len(fields) == 0 {
+		return errors.New("sha256sum gave no checksum")
+	}
+	if fields[0] != want {
+		return fmt.Errorf("Checksum mismatch: %.12s here, %.12s on the host", want, fields[0])
+	}
+	return nil
+}
+
+// sshCommand returns the ssh arguments to run a command on a host
+func sshCommand(host *Host, command ...string) []string {
+	args := append(host.Settings().Args(), host.FQDN)
+	return append(args, shellJoin(command))
+}
+
+// remotePath returns the scp/rsync path of a file on a host
+func remotePath(host *Host, p string) string {
+	if user := host.Settings().User; user != "" {
+		return fmt.Sprintf("%s@%s:%s", user, host.FQDN, p)
+	}
+	return host.FQDN + ":" + p
+}
+
+// localPath returns a local path, relative to the directory of the item
+func (t *Transfer) localPath(p string) string {
+	if filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(filepath.Dir(t.path), p)
+}
+
+// mode returns the mode to give the copied file, if any
+func (t *Transfer) mode() (os.FileMode, error) {
+	if t.Mode == "" {
+		return 0, nil
+	}
+
+	mode, err := strconv.ParseUint(t.Mode, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid mode %q", t.Mode)
+	}
+	return os.FileMode(mode), nil
+}
+
+func (t *Transfer) direction() string {
+	if t.Direction == "" {
+		return Push
+	}
+	return t.Direction
+}
+
+// PrintTransferResults prints a table of the results of a transfer and returns
+// whether all of the hosts succeeded
+func PrintTransferResults(results []TransferResult) bool {
+	red := color.New(color.FgRed, color.Bold).SprintfFunc()
+	green := color.New(color.FgGreen, color.Bold).SprintfFunc()
+
+	ok := true
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tSTATUS\tDETAIL")
+	for _, r := range results {
+		status := green("ok")
+		if r.Failed {
+			status = red("failed")
+			ok = false
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", r.Host, status, r.Detail)
+	}
+	w.Flush()
+	return ok
+}
+
+// MakeCLI creates the CLI tree for a Transfer item
+func (t Transfer) MakeCLI() []cli.Command {
+	sc := make([]cli.Command, 0, len(t.Hosts))
+	for _, key := range commandHostKey(t.Hosts) {
+		key := key
+		sc = append(sc, cli.Command{
+			Name:     key,
+			Usage:    t.Hosts[key],
+			HideHelp: true,
+			Flags:    t.Flags(),
+			Action: func(cl *cli.Context) {
+				t.run(key, runOptionsFrom(cl))
+			},
+		})
+	}
+	return sc
+}
+
+// ID returns the ID of the item
+func (t Transfer) ID() string {
+	return t.id
+}
+
+// Type returns the type of the item
+func (t Transfer) Type() string {
+	return t.RawType
+}
+
+// Path returns the path of the item
+func (t Transfer) Path() string {
+	return t.path
+}
+
+// Alias returns the alias of the item
+func (t Transfer) Alias() string {
+	return t.RawAlias
+}
+
+// Summary returns the summary of the item
+func (t Transfer) Summary() string {
+	return t.RawSummary
+}
+
+// References returns the `see_also` references of the item
+func (t Transfer) References() []string {
+	return t.SeeAlso
+}
+
+// bind sets the fields of the item that are not read from its file
+func (t *Transfer) bind(r *Repo, p string) {
+	t.id = asKey(p)
+	t.path = p
+	t.repo = r
+}
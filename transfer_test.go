@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testTransfer creates a transfer next to a file to push, and records the
+// commands it runs instead of running them
+func testTransfer(t *testing.T, r *Repo) (*Transfer, *[]string, func()) {
+	dir, _ := ioutil.TempDir("", "sagacity")
+	ioutil.WriteFile(filepath.Join(dir, "pgbouncer.ini"), []byte("[databases]\n"), 0644)
+
+	tr := &Transfer{
+		Source:      "pgbouncer.ini",
+		Destination: "/etc/pgbouncer/pgbouncer.ini",
+		Mode:        "0640",
+		Checksum:    true,
+	}
+	tr.bind(r, filepath.Join(dir, "push.yaml"))
+
+	var calls []string
+	orig := runTransfer
+	runTransfer = func(name string, args ...string) (string, error) {
+		call := name + " " + strings.Join(args, " ")
+		calls = append(calls, call)
+
+		switch {
+		case strings.Contains(call, "db5"):
+			return "", errors.New("scp failed: exit status 1")
+		case strings.Contains(call, "sha256sum"):
+			// The SHA256 sum of "[databases]\n"
+			return "12f4157dd771ee8c0c832022c06ed57aa03cfab6f35c242a7b855393fa4fafee  /etc/pgbouncer/pgbouncer.ini\n", nil
+		}
+		return "", nil
+	}
+
+	return tr, &calls, func() {
+		runTransfer = orig
+		os.RemoveAll(dir)
+	}
+}
+
+func TestTransferPushesToEveryHost(t *testing.T) {
+	assert := assert.New(t)
+	r := NewRepo("test/repos/host_tests/printout")
+	tr, calls, cleanup := testTransfer(t, r)
+	defer cleanup()
+
+	hosts, err := r.GetHosts("db ro all")
+	assert.Nil(err)
+	results := tr.Transfer(hosts)
+
+	assert.Equal(4, len(results))
+	assert.Equal(TransferResult{Host: "db2.cluster3.company.net", Detail: "ok, checksum verified"}, results[0])
+	assert.Equal(TransferResult{Host: "db5.cluster3.company.net", Failed: true, Detail: "scp failed: exit status 1"}, results[1])
+	assert.False(results[2].Failed)
+	assert.False(results[3].Failed)
+
+	src := filepath.Join(filepath.Dir(tr.Path()), "pgbouncer.ini")
+	assert.Equal([]string{
+		"scp -q " + src + " db2.cluster3.company.net:/etc/pgbouncer/pgbouncer.ini",
+		"ssh db2.cluster3.company.net chmod 0640 /etc/pgbouncer/pgbouncer.ini",
+		"ssh db2.cluster3.company.net sha256sum /etc/pgbouncer/pgbouncer.ini",
+	}, (*calls)[:3])
+}
+
+func TestTransferUsesSSHSettings(t *testing.T) {
+	assert := assert.New(t)
+	tr, calls, cleanup := testTransfer(t, &Repo{})
+	defer cleanup()
+
+	host := &Host{FQDN: "db1", SSH: SSHSettings{User: "ops", Port: 2222}}
+	tr.Checksum = false
+	tr.Mode = ""
+
+	tr.Transfer([]*Host{host})
+	tr.Tool = "rsync"
+	tr.Transfer([]*Host{host})
+
+	src := tr.localPath("pgbouncer.ini")
+	assert.Equal([]string{
+		"scp -q -P 2222 " + src + " ops@db1:/etc/pgbouncer/pgbouncer.ini",
+		"rsync -t -e ssh -l ops -p 2222 " + src + " ops@db1:/etc/pgbouncer/pgbouncer.ini",
+	}, *calls)
+}
+
+func TestTransferThroughProxyJump(t *testing.T) {
+	assert := assert.New(t)
+	tr, calls, cleanup := testTransfer(t, &Repo{})
+	defer cleanup()
+
+	host := &Host{FQDN: "db1", SSH: SSHSettings{ProxyJump: "ops@bastion:2222"}}
+	tr.Checksum = false
+	tr.Mode = ""
+
+	tr.Transfer([]*Host{host})
+	tr.Tool = "rsync"
+	tr.Transfer([]*Host{host})
+
+	src := tr.localPath("pgbouncer.ini")
+	assert.Equal([]string{
+		"scp -q -J ops@bastion:2222 " + src + " db1:/etc/pgbouncer/pgbouncer.ini",
+		"rsync -t -e ssh -J ops@bastion:2222 " + src + " db1:/etc/pgbouncer/pgbouncer.ini",
+	}, *calls)
+}
+
+func TestTransferPullsFromEveryHost(t *testing.T) {
+	assert := assert.New(t)
+	tr, calls, cleanup := testTransfer(t, &Repo{})
+	defer cleanup()
+
+	tr.Direction = Pull
+	tr.Source, tr.Destination = "/var/log/syslog", "logs"
+	tr.Checksum, tr.Mode = false, ""
+
+	results := tr.Transfer([]*Host{{FQDN: "db1"}, {FQDN: "db2"}})
+
+	dest := filepath.Join(filepath.Dir(tr.Path()), "logs")
+	assert.False(results[0].Failed)
+	assert.Equal([]string{
+		"scp -q db1:/var/log/syslog " + filepath.Join(dest, "db1"),
+		"scp -q db2:/var/log/syslog " + filepath.Join(dest, "db2"),
+	}, *calls)
+}
+
+func TestTransferChecksumMismatch(t *testing.T) {
+	assert := assert.New(t)
+	tr, _, cleanup := testTransfer(t, &Repo{})
+	defer cleanup()
+
+	ioutil.WriteFile(tr.localPath("pgbouncer.ini"), []byte("changed\n"), 0644)
+	results := tr.Transfer([]*Host{{FQDN: "db1"}})
+
+	assert.True(results[0].Failed)
+	assert.Contains(results[0].Detail, "Checksum mismatch")
+}
+
+func TestTransferRejectsBadModes(t *testing.T) {
+	assert := assert.New(t)
+	tr, calls, cleanup := testTransfer(t, &Repo{})
+	defer cleanup()
+
+	tr.Mode = "rw-r--r--"
+	results := tr.Transfer([]*Host{{FQDN: "db1"}})
+
+	assert.Equal(`Invalid mode "rw-r--r--"`, results[0].Detail)
+	assert.Equal(0, len(*calls))
+}
+
+func TestTransferRiskAndWindows(t *testing.T) {
+	assert := assert.New(t)
+	repos := testParentRepos()
+	shop := repos["shop"].Subrepos["ops"]
+	tr, _, cleanup := testTransfer(t, shop)
+	defer cleanup()
+
+	assert.Equal(RiskDisruptive, tr.Risk())
+
+	// Transfers are confirmed like commands, and never taken as a no
+	_, restore := testConfirm(nil)
+	defer restore()
+	err := confirmRisk(tr.repo, "transfer", tr.Risk(), Defaults{}, "db", nil, false)
+	assert.EqualError(err, "The transfer is disruptive, and stdin is not a terminal to ask for confirmation on; --yes confirms transfers up to safe")
+
+	// The windows and freezes of shop apply to its transfers too
+	assert.Nil(tr.Guard(at("2026-10-19 23:00", "Europe/Stockholm")))
+	assert.Error(tr.Guard(at("2026-10-19 12:00", "Europe/Stockholm")))
+	assert.Contains(tr.Guard(at("2026-11-27 23:00", "Europe/Stockholm")).Error(), "Black Friday sales")
+
+	tr.RawRisk = RiskReadOnly
+	assert.Nil(tr.Guard(at("2026-11-27 23:00", "Europe/Stockholm")))
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The transports that commands can be run with
+const (
+	SystemTransport = "system"
+	NativeTransport = "native"
+)
+
+// defaultKeepalive is how often the native transport checks that its
+// connections are alive
+const defaultKeepalive = 30 * time.Second
+
+// killGrace is how long a command that is cancelled gets to exit after it is
+// asked to terminate
+const killGrace = 5 * time.Second
+
+// SSHConfig chooses how commands are run on hosts
+type SSHConfig struct {
+	// Transport is "system" to run the ssh binary, or "native" to use the
+	// SSH client built into sagacity
+	Transport string `yaml:"transport,omitempty"`
+
+	// KnownHosts are the known_hosts files the native transport checks host
+	// keys against. ~/.ssh/known_hosts is used if there are none.
+	KnownHosts []string `yaml:"known_hosts,omitempty"`
+
+	// Keepalive is how often the native transport sends keepalives
+	Keepalive time.Duration `yaml:"keepalive,omitempty"`
+}
+
+// A Transport runs commands on hosts without a terminal, which interactive
+// shells never use
+type Transport interface {
+	// Run runs a command on a host, writing its output to stdout and stderr.
+	// When the context is done, the command is asked to terminate, its
+	// connection is closed and the error of the context is returned.
+	Run(ctx context.Context, host *Host, command string, stdout, stderr io.Writer) error
+
+	// Close closes any connections the transport keeps open
+	Close() error
+}
+
+// NewTransport returns the transport chosen in the configuration
+func NewTransport(c SSHConfig) (Transport, error) {
+	switch c.Transport {
+	case "", SystemTransport:
+		return systemTransport{}, nil
+	case NativeTransport:
+		return newNativeTransport(c), nil
+	}
+	return nil, fmt.Errorf("Unknown ssh transport %q; use %s or %s", c.Transport, SystemTransport, NativeTransport)
+}
+
+// systemTransport runs commands with the ssh binary, like interactive
+// sessions do
+type systemTransport struct{}
+
+func (systemTransport) Run(ctx context.Context, host *Host, command string, stdout, stderr io.Writer) error {
+	args := host.Command(command)
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	// Let ssh close the connection before killing it. Without a terminal,
+	// whether the command stops on the host as well is up to the host.
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	cmd.WaitDelay = killGrace
+
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func (systemTransport) Close() error {
+	return nil
+}
+
+// nativeTransport runs commands with the SSH client of golang.org/x/crypto,
+// reusing a connection per host until it is closed
+type nativeTransport struct {
+	config  SSHConfig
+	clients map[string]*ssh.Client
+	mu      sync.Mutex
+
+	// The ssh agent, once it is needed
+	agentConn   net.Conn
+	agentClient agent.ExtendedAgent
+}
+
+func newNativeTransport(c SSHConfig) *nativeTransport {
+	if c.Keepalive == 0 {
+		c.Keepalive = defaultKeepalive
+	}
+	return &nativeTransport{config: c, clients: make(map[string]*ssh.Client)}
+}
+
+func (t *nativeTransport) Run(ctx context.Context, host *Host, command string, stdout, stderr io.Writer) error {
+	client, err := t.client(host.FQDN, host.Settings())
+	if err != nil {
+		return err
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	session.Stdout = stdout
+	session.Stderr = stderr
+	if err := session.Start(command); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	// Ask the command to terminate, and close the session if it doesn't.
+	// Servers can ignore signals, so it may keep running on the host.
+	session.Signal(ssh.SIGTERM)
+	select {
+	case <-done:
+	case <-time.After(killGrace):
+		session.Close()
+	}
+	return ctx.Err()
+}
+
+func (t *nativeTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for key, client := range t.clients {
+		client.Close()
+		delete(t.clients, key)
+	}
+
+	if t.agentConn != nil {
+		t.agentConn.Close()
+		t.agentConn, t.agentClient = nil, nil
+	}
+	return nil
+}
+
+// client returns a connection to a host, reusing an open one if there is one
+func (t *nativeTransport) client(fqdn string, s SSHSettings) (*ssh.Client, error) {
+	if s.User == "" {
+		if u, err := user.Current(); err == nil {
+			s.User = u.Username
+		}
+	}
+
+	port := s.Port
+	if port == 0 {
+		port = 22
+	}
+	addr := net.JoinHostPort(fqdn, strconv.Itoa(port))
+	key := s.User + "@" + addr + " via " + s.ProxyJump
+
+	t.mu.Lock()
+	client, ok := t.clients[key]
+	t.mu.Unlock()
+	if ok {
+		return client, nil
+	}
+
+	config, err := t.clientConfig(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.ProxyJump == "" {
+		client, err = ssh.Dial("tcp", addr, config)
+	} else {
+		client, err = t.jump(s, addr, config)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Connecting to %s failed: %s", addr, err)
+	}
+
+	// Another goroutine may have connected in the meantime.
+	t.mu.Lock()
+	if other, ok := t.clients[key]; ok {
+		t.mu.Unlock()
+		client.Close()
+		return other, nil
+	}
+	t.clients[key] = client
+	t.mu.Unlock()
+
+	go t.keepalive(key, client)
+	return client, nil
+}
+
+// jump connects to an address through the ProxyJump host of the settings
+func (t *nativeTransport) jump(s SSHSettings, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	js := SSHSettings{User: s.User, Identity: s.Identity}
+	jhost := s.ProxyJump
+	if x := strings.Index(jhost, "@"); x != -1 {
+		js.User, jhost = jhost[:x], jhost[x+1:]
+	}
+	if h, p, err := net.SplitHostPort(jhost); err == nil {
+		jhost = h
+		js.Port, _ = strconv.Atoi(p)
+	}
+
+	jump, err := t.client(jhost, js)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := jump.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// keepalive sends keepalives on a connection until it is closed or stops
+// answering, and forgets about it then
+func (t *nativeTransport) keepalive(key string, client *ssh.Client) {
+	done := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(done)
+	}()
+
+	ticker := time.NewTicker(t.config.Keepalive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+		case <-ticker.C:
+			if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+				continue
+			}
+			client.Close()
+		}
+
+		t.mu.Lock()
+		if t.clients[key] == client {
+			delete(t.clients, key)
+		}
+		t.mu.Unlock()
+		return
+	}
+}
+
+// clientConfig returns the authentication and host key checking to use
+func (t *nativeTransport) clientConfig(s SSHSettings) (*ssh.ClientConfig, error) {
+	// Options are for the ssh binary, and ignoring them could mean connecting
+	// in another way than the user asked for
+	if len(s.Options) != 0 {
+		return nil, fmt.Errorf(
+			"The native transport does not support ssh options (%s); use the system transport for these hosts",
+			strings.Join(s.Options, ", "),
+		)
+	}
+
+	hostKeys, err := t.hostKeyCallback()
+	if err != nil {
+		return nil, err
+	}
+
+	var auth []ssh.AuthMethod
+	if s.Identity != "" {
+		signer, err := readIdentity(s.Identity)
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+
+	if a := t.agent(); a != nil {
+		auth = append(auth, ssh.PublicKeysCallback(a.Signers))
+	}
+
+	if len(auth) == 0 {
+		return nil, errors.New("No ssh agent is running and no identity is set; the native transport has no way to log in")
+	}
+
+	return &ssh.ClientConfig{
+		User:            s.User,
+		Auth:            auth,
+		HostKeyCallback: hostKeys,
+		Timeout:         10 * time.Second,
+	}, nil
+}
+
+// agent returns the ssh agent, connecting to it the first time. It is nil if
+// there is no agent. All connections share it, and Close disconnects it.
+func (t *nativeTransport) agent() agent.ExtendedAgent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.agentClient == nil {
+		sock := os.Getenv("SSH_AUTH_SOCK")
+		if sock == "" {
+			return nil
+		}
+
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			return nil
+		}
+		t.agentConn, t.agentClient = conn, agent.NewClient(conn)
+	}
+	return t.agentClient
+}
+
+// hostKeyCallback checks host keys against the known_hosts files. Hosts that
+// are not in them are refused; connect with ssh once to add them.
+func (t *nativeTransport) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	files := t.config.KnownHosts
+	if len(files) == 0 {
+		files = []string{"~/.ssh/known_hosts"}
+	}
+
+	var existing []string
+	for _, fn := range files {
+		fn = expandHome(fn)
+		if _, err := os.Stat(fn); err == nil {
+			existing = append(existing, fn)
+		}
+	}
+
+	if len(existing) == 0 {
+		return nil, fmt.Errorf("None of the known_hosts files exist: %s", strings.Join(files, ", "))
+	}
+	return knownhosts.New(existing...)
+}
+
+// readIdentity reads a private key file
+func readIdentity(fn string) (ssh.Signer, error) {
+	data, err := ioutil.ReadFile(expandHome(fn))
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(data)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		return nil, fmt.Errorf("%s is protected by a passphrase; add it to your ssh agent instead", fn)
+	}
+	return signer, err
+}
+
+// expandHome expands a leading ~ to the home directory
+func expandHome(p string) string {
+	if p != "~" && !strings.HasPrefix(p, "~/") {
+		return p
+	}
+
+	u, err := user.Current()
+	if err != nil {
+		return p
+	}
+	return filepath.Join(u.HomeDir, p[1:])
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testSSHServer is an SSH server that echoes the commands it is asked to run
+// and exits with the status given after "exit ", if any. "sleep" runs until
+// it is signalled.
+type testSSHServer struct {
+	listener net.Listener
+	hostKey  ssh.Signer
+	conns    int32
+}
+
+func newTestSSHServer(t *testing.T, authorized ssh.PublicKey) *testSSHServer {
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	hostKey, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	s := &testSSHServer{listener: l, hostKey: hostKey}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(authorized.Marshal()) {
+				return nil, fmt.Errorf("unknown key")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn, config)
+		}
+	}()
+	return s
+}
+
+func (s *testSSHServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	atomic.AddInt32(&s.conns, 1)
+	go ssh.DiscardRequests(reqs)
+
+	for nc := range chans {
+		switch nc.ChannelType() {
+		case "session":
+			ch, creqs, _ := nc.Accept()
+			go s.session(ch, creqs)
+
+		case "direct-tcpip":
+			// Forward to the address asked for, like a jump host does
+			var target struct {
+				Host       string
+				Port       uint32
+				OriginHost string
+				OriginPort uint32
+			}
+			ssh.Unmarshal(nc.ExtraData(), &target)
+
+			upstream, err := net.Dial("tcp", net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+			if err != nil {
+				nc.Reject(ssh.ConnectionFailed, err.Error())
+				continue
+			}
+			ch, creqs, _ := nc.Accept()
+			go ssh.DiscardRequests(creqs)
+			go func() {
+				io.Copy(ch, upstream)
+				ch.Close()
+			}()
+			go func() {
+				io.Copy(upstream, ch)
+				upstream.Close()
+			}()
+
+		default:
+			nc.Reject(ssh.UnknownChannelType, "")
+		}
+	}
+}
+
+func (s *testSSHServer) session(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+	for req := range reqs {
+		if req.Type != "exec" {
+			req.Reply(false, nil)
+			continue
+		}
+		req.Reply(true, nil)
+
+		command := string(req.Payload[4:])
+		fmt.Fprintf(ch, "ran: %s\n", command)
+
+		if command == "sleep" {
+			for req := range reqs {
+				if req.Type == "signal" {
+					fmt.Fprintln(ch, "terminated")
+					break
+				}
+			}
+		}
+
+		status := make([]byte, 4)
+		if strings.HasPrefix(command, "exit ") {
+			code, _ := strconv.Atoi(strings.TrimPrefix(command, "exit "))
+			binary.BigEndian.PutUint32(status, uint32(code))
+		}
+		ch.SendRequest("exit-status", false, status)
+		return
+	}
+}
+
+func (s *testSSHServer) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+// knownHost returns a known_hosts line for the server
+func (s *testSSHServer) knownHost() string {
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(s.port()))
+	return knownhosts.Line([]string{knownhosts.Normalize(addr)}, s.hostKey.PublicKey())
+}
+
+// testTransport returns a native transport trusting the given servers, and
+// the identity file to log in to them with
+func testTransport(t *testing.T, servers func(ssh.PublicKey) []*testSSHServer) (*nativeTransport, string, []*testSSHServer) {
+	dir := t.TempDir()
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity := filepath.Join(dir, "id_ed25519")
+	ioutil.WriteFile(identity, pem.EncodeToMemory(block), 0600)
+
+	sshPub, _ := ssh.NewPublicKey(pub)
+	srvs := servers(sshPub)
+
+	var lines []string
+	for _, s := range srvs {
+		lines = append(lines, s.knownHost())
+	}
+	knownHosts := filepath.Join(dir, "known_hosts")
+	ioutil.WriteFile(knownHosts, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+
+	tr := newNativeTransport(SSHConfig{Transport: NativeTransport, KnownHosts: []string{knownHosts}})
+	t.Cleanup(func() { tr.Close() })
+	return tr, identity, srvs
+}
+
+func testSSHHost(port int, identity string) *Host {
+	return &Host{
+		FQDN: "127.0.0.1",
+		SSH:  SSHSettings{User: "ops", Port: port, Identity: identity},
+	}
+}
+
+func TestNewTransport(t *testing.T) {
+	assert := assert.New(t)
+
+	tr, err := NewTransport(SSHConfig{})
+	assert.Nil(err)
+	assert.Equal(systemTransport{}, tr)
+
+	tr, err = NewTransport(SSHConfig{Transport: NativeTransport})
+	assert.Nil(err)
+	assert.Equal(defaultKeepalive, tr.(*nativeTransport).config.Keepalive)
+
+	_, err = NewTransport(SSHConfig{Transport: "telnet"})
+	assert.Contains(err.Error(), `Unknown ssh transport "telnet"`)
+}
+
+func TestNativeTransportRun(t *testing.T) {
+	assert := assert.New(t)
+
+	tr, identity, srvs := testTransport(t, func(key ssh.PublicKey) []*testSSHServer {
+		return []*testSSHServer{newTestSSHServer(t, key)}
+	})
+	host := testSSHHost(srvs[0].port(), identity)
+
+	var out strings.Builder
+	assert.Nil(tr.Run(context.Background(), host, "uptime", &out, ioutil.Discard))
+	assert.Nil(tr.Run(context.Background(), host, "hostname", &out, ioutil.Discard))
+	assert.Equal("ran: uptime\nran: hostname\n", out.String())
+
+	// Both commands went over the same connection
+	assert.Equal(int32(1), atomic.LoadInt32(&srvs[0].conns))
+
+	err := tr.Run(context.Background(), host, "exit 3", ioutil.Discard, ioutil.Discard)
+	exit, ok := err.(*ssh.ExitError)
+	assert.True(ok)
+	assert.Equal(3, exit.ExitStatus())
+}
+
+func TestNativeTransportTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	tr, identity, srvs := testTransport(t, func(key ssh.PublicKey) []*testSSHServer {
+		return []*testSSHServer{newTestSSHServer(t, key)}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	var out strings.Builder
+	err := tr.Run(ctx, testSSHHost(srvs[0].port(), identity), "sleep", &out, ioutil.Discard)
+	assert.Equal(context.DeadlineExceeded, err)
+	assert.Equal("ran: sleep\nterminated\n", out.String())
+}
+
+func TestNativeTransportUnknownHostKey(t *testing.T) {
+	assert := assert.New(t)
+
+	var other *testSSHServer
+	tr, identity, _ := testTransport(t, func(key ssh.PublicKey) []*testSSHServer {
+		other = newTestSSHServer(t, key)
+		return []*testSSHServer{newTestSSHServer(t, key)}
+	})
+
+	// The server is listening, but its key is not in known_hosts
+	err := tr.Run(context.Background(), testSSHHost(other.port(), identity), "uptime", ioutil.Discard, ioutil.Discard)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "knownhosts")
+	assert.Equal(int32(0), atomic.LoadInt32(&other.conns))
+}
+
+func TestNativeTransportProxyJump(t *testing.T) {
+	assert := assert.New(t)
+
+	tr, identity, srvs := testTransport(t, func(key ssh.PublicKey) []*testSSHServer {
+		return []*testSSHServer{newTestSSHServer(t, key), newTestSSHServer(t, key)}
+	})
+	jump, target := srvs[0], srvs[1]
+
+	host := testSSHHost(target.port(), identity)
+	host.SSH.ProxyJump = fmt.Sprintf("ops@127.0.0.1:%d", jump.port())
+
+	var out strings.Builder
+	assert.Nil(tr.Run(context.Background(), host, "uptime", &out, ioutil.Discard))
+	assert.Equal("ran: uptime\n", out.String())
+	assert.Equal(int32(1), atomic.LoadInt32(&jump.conns))
+	assert.Equal(int32(1), atomic.LoadInt32(&target.conns))
+}
+
+func TestNativeTransportNoAuth(t *testing.T) {
+	assert := assert.New(t)
+
+	tr, _, srvs := testTransport(t, func(key ssh.PublicKey) []*testSSHServer {
+		return []*testSSHServer{newTestSSHServer(t, key)}
+	})
+
+	err := tr.Run(context.Background(), testSSHHost(srvs[0].port(), ""), "uptime", ioutil.Discard, ioutil.Discard)
+	assert.Contains(err.Error(), "no way to log in")
+}
+
+func TestNativeTransportRefusesOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	tr, identity, srvs := testTransport(t, func(key ssh.PublicKey) []*testSSHServer {
+		return []*testSSHServer{newTestSSHServer(t, key)}
+	})
+	host := testSSHHost(srvs[0].port(), identity)
+	host.SSH.Options = []string{"ProxyCommand nc %h %p"}
+
+	err := tr.Run(context.Background(), host, "uptime", ioutil.Discard, ioutil.Discard)
+	assert.EqualError(err, "The native transport does not support ssh options (ProxyCommand nc %h %p); use the system transport for these hosts")
+	assert.Equal(int32(0), atomic.LoadInt32(&srvs[0].conns))
+}
+
+func TestNativeTransportClosesAgent(t *testing.T) {
+	assert := assert.New(t)
+
+	tr, identity, srvs := testTransport(t, func(key ssh.PublicKey) []*testSSHServer {
+		return []*testSSHServer{newTestSSHServer(t, key)}
+	})
+
+	// An agent without keys, which tells when its connection is closed
+	sock := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	t.Setenv("SSH_AUTH_SOCK", sock)
+
+	closed := make(chan bool)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		agent.ServeAgent(agent.NewKeyring(), conn)
+		closed <- true
+	}()
+
+	host := testSSHHost(srvs[0].port(), identity)
+	assert.Nil(tr.Run(context.Background(), host, "uptime", ioutil.Discard, ioutil.Discard))
+	assert.Nil(tr.Close())
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the agent connection was not closed")
+	}
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/codegangsta/cli"
+	"github.com/fatih/color"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+func init() {
+	RegisterItemType("tunnel", ItemType{
+		New: func() Item { return &Tunnel{} },
+	})
+}
+
+// Tunnel is a set of ssh port forwards, through the `via` host if there is one
+// or else to the one target of all of the forwards
+type Tunnel struct {
+	RawType    string    `yaml:"type"`
+	RawSummary string    `yaml:"summary"`
+	RawAlias   string    `yaml:"alias"`
+	Via        string    `yaml:"via"`
+	Forwards   []Forward `yaml:"forwards"`
+	SeeAlso    []string  `yaml:"see_also"`
+	id         string
+	path       string
+	repo       *Repo
+}
+
+// Forward is one port forward of a tunnel
+type Forward struct {
+	// Local is the port to listen to on this machine, for a local forward
+	Local int `yaml:"local"`
+
+	// Remote is the port to listen to on the ssh host, for a remote forward
+	Remote int `yaml:"remote"`
+
+	// Target is the host definition to connect to for a local forward. Remote
+	// forwards always connect to this machine.
+	Target string `yaml:"target"`
+
+	// Port is the port to connect to
+	Port int `yaml:"port"`
+}
+
+// tunnelState is what is stored about a running tunnel
+type tunnelState struct {
+	Name      string    `json:"name"`
+	Ref       string    `json:"ref"`
+	PID       int       `json:"pid"`
+	Endpoints []string  `json:"endpoints"`
+	Started   time.Time `json:"started"`
+}
+
+// How long to wait before reconnecting a tunnel. The delay doubles for every
+// failed attempt, and starts over once a connection has stayed up.
+const (
+	tunnelRetryMin = time.Second
+	tunnelRetryMax = 30 * time.Second
+)
+
+func (t Tunnel) String() string {
+	return fmt.Sprintf("T: %s (%d)", t.ID(), len(t.Forwards))
+}
+
+// Execute starts the tunnel in the background
+func (t *Tunnel) Execute(c *cli.Context) {
+	args, endpoints, err := t.sshArgs()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if c.Bool("foreground") {
+		t.printEndpoints(endpoints)
+		superviseTunnel(args, nil)
+		return
+	}
+
+	state, err := startTunnel(tunnelDir(), t.Ref(), endpoints)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("Started tunnel %s (pid %d); stop it with `sp tunnels stop %s`\n", state.Name, state.PID, state.Name)
+	t.printEndpoints(endpoints)
+}
+
+// Flags returns the flags of the command of the item
+func (t Tunnel) Flags() []cli.Flag {
+	return []cli.Flag{
+		cli.BoolFlag{
+			Name:  "foreground",
+			Usage: "keep the tunnel in the foreground instead of starting it in the background",
+		},
+	}
+}
+
+func (t *Tunnel) printEndpoints(endpoints []string) {
+	green := color.New(color.FgGreen, color.Bold).SprintfFunc()
+	for _, endpoint := range endpoints {
+		fmt.Println("  " + green(endpoint))
+	}
+}
+
+// Ref returns the reference to the tunnel, like "repo sub tunnel"
+func (t *Tunnel) Ref() string {
+	return strings.Join(append(t.repo.PathKeys(), t.id), " ")
+}
+
+// sshArgs returns the arguments to ssh for the tunnel, and a description of
+// the endpoints of the forwards
+func (t *Tunnel) sshArgs() (args []string, endpoints []string, err error) {
+	if len(t.Forwards) == 0 {
+		return nil, nil, fmt.Errorf("%s has no forwards", t.ID())
+	}
+
+	var session *Host
+	if t.Via != "" {
+		if session, err = t.repo.GetHost(t.Via); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var forwards []string
+	for _, f := range t.Forwards {
+		if (f.Local == 0) == (f.Remote == 0) || f.Port == 0 {
+			return nil, nil, fmt.Errorf("%s: every forward needs a port and either a local or a remote port", t.ID())
+		}
+
+		if f.Remote != 0 {
+			if session == nil {
+				return nil, nil, fmt.Errorf("%s: remote forwards need a `via` host", t.ID())
+			}
+
+			forwards = append(forwards, "-R", fmt.Sprintf("%d:localhost:%d", f.Remote, f.Port))
+			endpoints = append(endpoints, fmt.Sprintf("%s:%d -> localhost:%d", session.FQDN, f.Remote, f.Port))
+			continue
+		}
+
+		target, err := t.repo.GetHost(f.Target)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// Without a jump host the session goes to the target itself, from
+		// where the target is localhost.
+		dest := target.FQDN
+		if t.Via == "" {
+			if session != nil && session.FQDN != target.FQDN {
+				return nil, nil, fmt.Errorf("%s: forwards to different hosts need a `via` host", t.ID())
+			}
+			session = target
+			dest = "localhost"
+		}
+
+		forwards = append(forwards, "-L", fmt.Sprintf("%d:%s:%d", f.Local, dest, f.Port))
+		endpoints = append(endpoints, fmt.Sprintf("localhost:%d -> %s:%d", f.Local, target.FQDN, f.Port))
+	}
+
+	args = append([]string{"-N", "-o", "ExitOnForwardFailure=yes", "-o", "ServerAliveInterval=15", "-o", "ServerAliveCountMax=3"}, session.Settings().Args()...)
+	args = append(args, forwards...)
+	args = append(args, session.FQDN)
+	return args, endpoints, nil
+}
+
+// MakeCLI makes a dummy CLI - Tunnel items have no subcommands
+func (t Tunnel) MakeCLI() []cli.Command {
+	return []cli.Command{}
+}
+
+// ID returns the ID of the item
+func (t Tunnel) ID() string {
+	return t.id
+}
+
+// Type returns the type of the item
+func (t Tunnel) Type() string {
+	return t.RawType
+}
+
+// Path returns the path of the item
+func (t Tunnel) Path() string {
+	return t.path
+}
+
+// Alias returns the alias of the item
+func (t Tunnel) Alias() string {
+	return t.RawAlias
+}
+
+// Summary returns the summary of the item
+func (t Tunnel) Summary() string {
+	return t.RawSummary
+}
+
+// References returns the `see_also` references of the item
+func (t Tunnel) References() []string {
+	return t.SeeAlso
+}
+
+// bind sets the fields of the item that are not read from its file
+func (t *Tunnel) bind(r *Repo, p string) {
+	t.id = asKey(p)
+	t.path = p
+	t.repo = r
+}
+
+// tunnelDir returns where the state of running tunnels is kept
+func tunnelDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "sagacity", "tunnels")
+}
+
+// tunnelName turns a tunnel reference into a name usable as a file name
+func tunnelName(ref string) string {
+	return strings.Join(strings.Fields(ref), "-")
+}
+
+// startTunnel starts a background process that keeps the tunnel with the
+// given reference up, and records it in the tunnel directory
+func startTunnel(dir, ref string, endpoints []string) (*tunnelState, error) {
+	name := tunnelName(ref)
+	if state, err := readTunnel(dir, name); err == nil && state.running() {
+		return nil, fmt.Errorf("Tunnel %s is already running (pid %d)", name, state.PID)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	logf, err := os.OpenFile(filepath.Join(dir, name+".log"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer logf.Close()
+
+	// The tunnel is kept up by another sagacity, detached from the terminal
+	// so that it outlives this one.
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(self, tunnelArgs(ref)...)
+	cmd.Stdout = logf
+	cmd.Stderr = logf
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	state := &tunnelState{
+		Name:      name,
+		Ref:       ref,
+		PID:       cmd.Process.Pid,
+		Endpoints: endpoints,
+		Started:   time.Now(),
+	}
+	cmd.Process.Release()
+
+	return state, writeTunnel(dir, state)
+}
+
+// RunTunnel keeps the tunnel with the given reference up until the process
+// is told to stop. It is what `sp tunnels run` does in the background.
+func RunTunnel(repos map[string]*Repo, ref string) error {
+	item, err := ResolveRef(repos, ref)
+	if err != nil {
+		return err
+	}
+
+	t, ok := item.(*Tunnel)
+	if !ok {
+		return fmt.Errorf("%s is not a tunnel", ref)
+	}
+
+	args, _, err := t.sshArgs()
+	if err != nil {
+		return err
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	superviseTunnel(args, stop)
+
+	os.Remove(filepath.Join(tunnelDir(), tunnelName(ref)+".json"))
+	return nil
+}
+
+// superviseTunnel runs ssh with the arguments, and runs it again whenever it
+// exits, until something is sent on `stop`
+func superviseTunnel(args []string, stop <-chan os.Signal) {
+	if stop == nil {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
+		stop = c
+	}
+
+	superviseCommand("ssh", args, stop, tunnelRetryMin, tunnelRetryMax)
+}
+
+// superviseCommand runs a command over and over until something is sent on
+// `stop`, waiting longer and longer between attempts that fail quickly
+func superviseCommand(name string, args []string, stop <-chan os.Signal, retryMin, retryMax time.Duration) (runs int) {
+	delay := retryMin
+	for {
+		cmd := exec.Command(name, args...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		started := time.Now()
+		log.Printf("Connecting: %s %s", name, strings.Join(args, " "))
+		if err := cmd.Start(); err != nil {
+			log.Print(err)
+			return
+		}
+		runs++
+
+		done := make(chan error, 1)
+		go func() { done <- cmd.Wait() }()
+
+		select {
+		case <-stop:
+			cmd.Process.Kill()
+			<-done
+			return
+		case err := <-done:
+			log.Printf("Tunnel closed: %v", err)
+		}
+
+		// A connection that stayed up for a while was not a failure.
+		if time.Since(started) > retryMax {
+			delay = retryMin
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(delay):
+		}
+
+		if delay *= 2; delay > retryMax {
+			delay = retryMax
+		}
+	}
+}
+
+// tunnelArgs returns the arguments that run the tunnel with the given reference
+func tunnelArgs(ref string) []string {
+	return append([]string{"tunnels", "run"}, strings.Fields(ref)...)
+}
+
+// running tells if the process of the tunnel is still alive
+func (s *tunnelState) running() bool {
+	p, err := os.FindProcess(s.PID)
+	if err != nil || p.Signal(syscall.Signal(0)) != nil {
+		return false
+	}
+
+	// The PID may since have been reused by another process, so make sure
+	// that it is still running the tunnel. Without /proc, there is no telling.
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", s.PID))
+	if err != nil {
+		_, noProc := os.Stat("/proc/self")
+		return noProc != nil
+	}
+
+	args := strings.Split(strings.TrimRight(string(data), "\x00"), "\x00")
+	want := tunnelArgs(s.Ref)
+	if len(args) < len(want) {
+		return false
+	}
+	return strings.Join(args[len(args)-len(want):], " ") == strings.Join(want, " ")
+}
+
+func readTunnel(dir, name string) (*tunnelState, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, name+".json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var state tunnelState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func writeTunnel(dir string, state *tunnelState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, state.Name+".json"), data, 0644)
+}
+
+// Tunnels returns the running tunnels, sorted by name. Tunnels whose
+// processes have died are cleaned up.
+func Tunnels(dir string) (tunnels []*tunnelState) {
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	for _, fn := range files {
+		state, err := readTunnel(dir, strings.TrimSuffix(filepath.Base(fn), ".json"))
+		if err != nil {
+			continue
+		}
+
+		if !state.running() {
+			os.Remove(fn)
+			continue
+		}
+		tunnels = append(tunnels, state)
+	}
+
+	sort.Slice(tunnels, func(i, j int) bool { return tunnels[i].Name < tunnels[j].Name })
+	return
+}
+
+// PrintTunnels prints a table of the running tunnels
+func PrintTunnels(dir string) {
+	tunnels := Tunnels(dir)
+	if len(tunnels) == 0 {
+		fmt.Println("No tunnels are running.")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tPID\tSTARTED\tENDPOINTS")
+	for _, t := range tunnels {
+		fmt.Fprintf(
+			w, "%s\t%d\t%s\t%s\n",
+			t.Name, t.PID, t.Started.Format("2006-01-02 15:04"), strings.Join(t.Endpoints, ", "),
+		)
+	}
+	w.Flush()
+}
+
+// StopTunnels stops the running tunnels with the given names, or all of them
+// if no names are given
+func StopTunnels(dir string, names []string) error {
+	running := make(map[string]*tunnelState)
+	for _, t := range Tunnels(dir) {
+		running[t.Name] = t
+	}
+
+	if len(names) == 0 {
+		for name := range running {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	var errs []string
+	for _, name := range names {
+		t, ok := running[tunnelName(name)]
+		if !ok {
+			errs = append(errs, fmt.Sprintf("No tunnel %s is running", name))
+			continue
+		}
+
+		p, _ := os.FindProcess(t.PID)
+		if err := p.Signal(syscall.SIGTERM); err != nil {
+			errs = append(errs, fmt.Sprintf("Stopping %s failed: %s", t.Name, err))
+			continue
+		}
+
+		os.Remove(filepath.Join(dir, t.Name+".json"))
+		fmt.Printf("Stopped %s (pid %d)\n", t.Name, t.PID)
+	}
+
+	if len(errs) != 0 {
+		return errors.New(strings.Join(errs, "\n"))
+	}
+	return nil
+}
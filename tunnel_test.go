@@ -0,0 +1,113 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func testTunnel(ref string) *Tunnel {
+	item, _ := ResolveRef(testParentRepos(), ref)
+	return item.(*Tunnel)
+}
+
+func TestTunnelArgsWithJumpHost(t *testing.T) {
+	assert := assert.New(t)
+	tun := testTunnel("shop ops dbtunnel")
+
+	args, endpoints, err := tun.sshArgs()
+
+	assert.Nil(err)
+	assert.Equal([]string{
+		"-N", "-o", "ExitOnForwardFailure=yes", "-o", "ServerAliveInterval=15", "-o", "ServerAliveCountMax=3",
+		"-l", "jump",
+		"-L", "5433:shop-db1.example.com:5432",
+		"-R", "9000:localhost:3000",
+		"bastion1.example.com",
+	}, args)
+	assert.Equal([]string{
+		"localhost:5433 -> shop-db1.example.com:5432",
+		"bastion1.example.com:9000 -> localhost:3000",
+	}, endpoints)
+	assert.Equal("shop ops dbtunnel", tun.Ref())
+}
+
+func TestTunnelArgsWithoutJumpHost(t *testing.T) {
+	assert := assert.New(t)
+	tun := testTunnel("shop ops direct")
+
+	args, _, err := tun.sshArgs()
+
+	assert.Nil(err)
+	assert.Equal([]string{"-L", "5433:localhost:5432", "shop-db1.example.com"}, args[len(args)-3:])
+
+	tun.Forwards = append(tun.Forwards, Forward{Local: 6380, Target: "cache primary", Port: 6379})
+	_, _, err = tun.sshArgs()
+	assert.EqualError(err, "direct: forwards to different hosts need a `via` host")
+
+	tun.Forwards = []Forward{{Remote: 9000, Port: 3000}}
+	_, _, err = tun.sshArgs()
+	assert.EqualError(err, "direct: remote forwards need a `via` host")
+}
+
+func TestSuperviseCommandReconnects(t *testing.T) {
+	assert := assert.New(t)
+	stop := make(chan os.Signal, 1)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		stop <- os.Interrupt
+	}()
+	runs := superviseCommand("false", nil, stop, time.Millisecond, 10*time.Millisecond)
+
+	assert.True(runs > 2, "ran %d times", runs)
+}
+
+func TestSuperviseCommandStops(t *testing.T) {
+	assert := assert.New(t)
+	stop := make(chan os.Signal, 1)
+	stop <- os.Interrupt
+
+	started := time.Now()
+	runs := superviseCommand("sleep", []string{"10"}, stop, time.Millisecond, time.Second)
+
+	assert.Equal(1, runs)
+	assert.True(time.Since(started) < 5*time.Second)
+}
+
+func TestListAndStopTunnels(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "sagacity")
+	defer os.RemoveAll(dir)
+
+	// A process with the command line of the tunnel, and one without
+	tunnel := exec.Command("sh", "-c", "sleep 30; :", "tunnels", "run", "shop", "ops", "dbtunnel")
+	tunnel.Start()
+	defer tunnel.Process.Kill()
+	other := exec.Command("sleep", "30")
+	other.Start()
+	defer other.Process.Kill()
+
+	ref := "shop ops dbtunnel"
+	writeTunnel(dir, &tunnelState{Name: "shop-ops-dbtunnel", Ref: ref, PID: tunnel.Process.Pid})
+	writeTunnel(dir, &tunnelState{Name: "dead", Ref: "dead", PID: 999999})
+	writeTunnel(dir, &tunnelState{Name: "reused", Ref: "reused", PID: other.Process.Pid})
+
+	tunnels := Tunnels(dir)
+	assert.Equal(1, len(tunnels))
+	assert.Equal("shop-ops-dbtunnel", tunnels[0].Name)
+
+	_, err := os.Stat(dir + "/dead.json")
+	assert.True(os.IsNotExist(err))
+	_, err = os.Stat(dir + "/reused.json")
+	assert.True(os.IsNotExist(err))
+
+	assert.EqualError(StopTunnels(dir, []string{"nope"}), "No tunnel nope is running")
+	assert.Nil(StopTunnels(dir, []string{"shop ops dbtunnel"}))
+
+	assert.NotNil(tunnel.Wait())
+	assert.Equal(0, len(Tunnels(dir)))
+}
@@ -9,14 +9,14 @@ import (
 	"strings"
 )
 
-// Helper for executing git commands
-func git(pwd string, args ...string) {
+// Helper for executing git commands, passing their output through to the terminal
+func git(pwd string, args ...string) error {
 	if pwd == "" {
 		pwd, _ = os.Getwd()
 	}
 	git, err := exec.LookPath("git")
 	if err != nil {
-		log.Fatal("no git :'(   ", err)
+		return fmt.Errorf("no git :'(   %s", err)
 	}
 
 	// why................
@@ -30,11 +30,23 @@ func git(pwd string, args ...string) {
 		Stderr: os.Stderr,
 	}
 
-	err = cmd.Run()
+	return cmd.Run()
+}
+
+// Helper for executing git commands and capturing their output
+func gitOutput(pwd string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = pwd
+
+	out, err := cmd.Output()
 	if err != nil {
-		log.Println("git command failed - aborting")
-		log.Fatal(err)
+		if ee, ok := err.(*exec.ExitError); ok && len(ee.Stderr) != 0 {
+			return "", fmt.Errorf("git %s: %s", args[0], strings.TrimSpace(string(ee.Stderr)))
+		}
+		return "", err
 	}
+
+	return strings.TrimSpace(string(out)), nil
 }
 
 func ask(prompt string) bool {
@@ -65,6 +77,14 @@ func getPath(p string) string {
 	return path
 }
 
+func absPath(p string) string {
+	path, err := filepath.Abs(p)
+	if err != nil {
+		return p
+	}
+	return path
+}
+
 func asKey(p string) string {
 	basename := filepath.Base(p)
 	return strings.TrimSuffix(basename, filepath.Ext(basename))
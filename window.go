@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"github.com/codegangsta/cli"
+	"strings"
+	"time"
+)
+
+// overrideFlag runs a command outside of its maintenance windows
+var overrideFlag = cli.StringFlag{
+	Name:  "override",
+	Usage: "run outside of the maintenance windows or during a freeze, for this reason",
+}
+
+// weekdays are the names of the days in windows
+var weekdays = map[string]time.Weekday{
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+	"sun": time.Sunday,
+}
+
+// dayGroups are names for several days at once
+var dayGroups = map[string][]string{
+	"weekdays": {"mon", "tue", "wed", "thu", "fri"},
+	"weekends": {"sat", "sun"},
+}
+
+// Window is a time of the week that commands are allowed to run in. A window
+// that ends before it starts goes on past midnight of the day it starts.
+type Window struct {
+	Days     []string `yaml:"days"`     // mon-sun, weekdays or weekends; every day if empty
+	Start    string   `yaml:"start"`    // 15:04
+	End      string   `yaml:"end"`      // 15:04
+	Timezone string   `yaml:"timezone"` // like Europe/Stockholm; local time if empty
+}
+
+// Freeze is a period during which commands are not allowed to run
+type Freeze struct {
+	Start    string `yaml:"start"` // 2006-01-02 or 2006-01-02 15:04
+	End      string `yaml:"end"`   // dates without a time include the whole day
+	Reason   string `yaml:"reason"`
+	Timezone string `yaml:"timezone"`
+}
+
+func (w Window) String() string {
+	days := "every day"
+	if len(w.Days) != 0 {
+		days = strings.Join(w.Days, ", ")
+	}
+
+	s := fmt.Sprintf("%s %s-%s", days, w.Start, w.End)
+	if w.Timezone != "" {
+		s += " " + w.Timezone
+	}
+	return s
+}
+
+// Contains tells if a time is within the window
+func (w Window) Contains(t time.Time) (bool, error) {
+	loc, err := location(w.Timezone)
+	if err != nil {
+		return false, err
+	}
+	start, err := clock(w.Start)
+	if err != nil {
+		return false, err
+	}
+	end, err := clock(w.End)
+	if err != nil {
+		return false, err
+	}
+	days, err := windowDays(w.Days)
+	if err != nil {
+		return false, err
+	}
+
+	t = t.In(loc)
+	now := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	today := days[t.Weekday()]
+	yesterday := days[(t.Weekday()+6)%7]
+
+	if start < end {
+		return today && now >= start && now < end, nil
+	}
+	return (today && now >= start) || (yesterday && now < end), nil
+}
+
+// Contains tells if a time is within the freeze
+func (f Freeze) Contains(t time.Time) (bool, error) {
+	start, end, err := f.period()
+	if err != nil {
+		return false, err
+	}
+	return !t.Before(start) && t.Before(end), nil
+}
+
+// period returns when the freeze starts, and the moment after it ends
+func (f Freeze) period() (time.Time, time.Time, error) {
+	loc, err := location(f.Timezone)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	start, _, err := freezeTime(f.Start, loc)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	end, wholeDay, err := freezeTime(f.End, loc)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	if wholeDay {
+		end = end.AddDate(0, 0, 1)
+	}
+	return start, end, nil
+}
+
+// location loads a timezone, the local one if it is empty
+func location(name string) (*time.Location, error) {
+	if name == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(name)
+}
+
+// clock parses a time of the day, like 22:00
+func clock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid time of day %q; use 15:04", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// freezeTime parses the start or end of a freeze, and tells if it is a date
+// without a time
+func freezeTime(s string, loc *time.Location) (time.Time, bool, error) {
+	if t, err := time.ParseInLocation("2006-01-02 15:04", s, loc); err == nil {
+		return t, false, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, loc); err == nil {
+		return t, true, nil
+	}
+	return time.Time{}, false, fmt.Errorf("Invalid date %q; use 2006-01-02 or 2006-01-02 15:04", s)
+}
+
+// windowDays returns which days of the week a window is on, indexed by
+// time.Weekday
+func windowDays(names []string) ([7]bool, error) {
+	var days [7]bool
+	if len(names) == 0 {
+		for x := range days {
+			days[x] = true
+		}
+		return days, nil
+	}
+
+	for _, name := range names {
+		group, ok := dayGroups[strings.ToLower(name)]
+		if !ok {
+			group = []string{strings.ToLower(name)}
+		}
+
+		for _, day := range group {
+			x, ok := weekdays[day]
+			if !ok {
+				return days, fmt.Errorf("Invalid day %q; use mon-sun, weekdays or weekends", name)
+			}
+			days[x] = true
+		}
+	}
+	return days, nil
+}
+
+// Guard returns why the command is not allowed to run at a time, if it is
+// not, see guard
+func (c *Command) Guard(t time.Time) error {
+	return guard(c.repo, c.Risk(), c.Windows, c.Freezes, t)
+}
+
+// guard returns why something of a repository that is not read-only cannot run
+// at a time, going by the closest windows and all of the freezes
+func guard(r *Repo, risk string, windows []Window, freezes []Freeze, t time.Time) error {
+	if risk == RiskReadOnly {
+		return nil
+	}
+
+	freezes = append([]Freeze{}, freezes...)
+	for p := r; p != nil; p = p.Parent {
+		freezes = append(freezes, p.Freezes...)
+		if len(windows) == 0 {
+			windows = p.Windows
+		}
+	}
+
+	for _, f := range freezes {
+		frozen, err := f.Contains(t)
+		if err != nil {
+			return fmt.Errorf("Invalid freeze: %s", err)
+		}
+		if frozen {
+			reason := ""
+			if f.Reason != "" {
+				reason = ": " + f.Reason
+			}
+			return fmt.Errorf("Changes are frozen from %s until %s%s", f.Start, f.End, reason)
+		}
+	}
+
+	if len(windows) == 0 {
+		return nil
+	}
+
+	for _, w := range windows {
+		open, err := w.Contains(t)
+		if err != nil {
+			return fmt.Errorf("Invalid maintenance window %s: %s", w, err)
+		}
+		if open {
+			return nil
+		}
+	}
+
+	names := make([]string, len(windows))
+	for x, w := range windows {
+		names[x] = w.String()
+	}
+	return fmt.Errorf("It is outside of the maintenance windows: %s", strings.Join(names, "; "))
+}
+
+// validateSchedule checks that maintenance windows and freezes can be read
+func validateSchedule(windows []Window, freezes []Freeze) error {
+	for _, w := range windows {
+		if _, err := w.Contains(time.Now()); err != nil {
+			return fmt.Errorf("invalid maintenance window %s: %s", w, err)
+		}
+	}
+	for _, f := range freezes {
+		if _, err := f.Contains(time.Now()); err != nil {
+			return fmt.Errorf("invalid freeze: %s", err)
+		}
+	}
+	return nil
+}
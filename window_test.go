@@ -0,0 +1,126 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// at returns a time in a timezone, like "2026-10-23 23:00"
+func at(s, tz string) time.Time {
+	loc, _ := time.LoadLocation(tz)
+	t, _ := time.ParseInLocation("2006-01-02 15:04", s, loc)
+	return t
+}
+
+func TestWindowContains(t *testing.T) {
+	assert := assert.New(t)
+	w := Window{Days: []string{"fri"}, Start: "22:00", End: "06:00", Timezone: "UTC"}
+
+	for s, open := range map[string]bool{
+		"2026-10-23 21:59": false,
+		"2026-10-23 22:00": true,
+		"2026-10-23 23:30": true,
+		"2026-10-24 05:59": true, // Friday night goes on into Saturday
+		"2026-10-24 06:00": false,
+		"2026-10-24 23:00": false,
+		"2026-10-23 05:00": false, // Thursday night is not in the window
+	} {
+		contains, err := w.Contains(at(s, "UTC"))
+		assert.Nil(err)
+		assert.Equal(open, contains, s)
+	}
+}
+
+func TestWindowContainsInTimezone(t *testing.T) {
+	assert := assert.New(t)
+	w := Window{Days: []string{"weekdays"}, Start: "22:00", End: "23:00", Timezone: "Europe/Stockholm"}
+
+	// Stockholm is two hours ahead of UTC in the summer
+	open, _ := w.Contains(at("2026-10-19 20:30", "UTC"))
+	assert.True(open)
+	open, _ = w.Contains(at("2026-10-19 22:30", "UTC"))
+	assert.False(open)
+
+	w = Window{Days: []string{"weekends"}, Start: "00:00", End: "23:59"}
+	open, _ = w.Contains(at("2026-10-24 12:00", "Local"))
+	assert.True(open)
+	open, _ = w.Contains(at("2026-10-23 12:00", "Local"))
+	assert.False(open)
+}
+
+func TestFreezeContains(t *testing.T) {
+	assert := assert.New(t)
+	f := Freeze{Start: "2026-11-27", End: "2026-11-30", Timezone: "Europe/Stockholm"}
+
+	for s, frozen := range map[string]bool{
+		"2026-11-26 23:59": false,
+		"2026-11-27 00:00": true,
+		"2026-11-30 23:59": true, // the end date is a part of the freeze
+		"2026-12-01 00:00": false,
+	} {
+		contains, err := f.Contains(at(s, "Europe/Stockholm"))
+		assert.Nil(err)
+		assert.Equal(frozen, contains, s)
+	}
+
+	f = Freeze{Start: "2026-11-27 18:00", End: "2026-11-27 20:00", Timezone: "UTC"}
+	frozen, _ := f.Contains(at("2026-11-27 19:00", "UTC"))
+	assert.True(frozen)
+	frozen, _ = f.Contains(at("2026-11-27 20:00", "UTC"))
+	assert.False(frozen)
+}
+
+func TestCommandGuard(t *testing.T) {
+	assert := assert.New(t)
+	repos := testParentRepos()
+
+	item, _ := ResolveRef(repos, "shop ops failover")
+	failover := item.(*Command)
+
+	// The failover has no windows of its own, so the ones of shop are used
+	assert.Nil(failover.Guard(at("2026-10-19 23:00", "Europe/Stockholm")))
+	assert.Nil(failover.Guard(at("2026-10-20 05:00", "Europe/Stockholm")))
+	assert.EqualError(
+		failover.Guard(at("2026-10-19 12:00", "Europe/Stockholm")),
+		"It is outside of the maintenance windows: weekdays 22:00-06:00 Europe/Stockholm",
+	)
+	assert.EqualError(
+		failover.Guard(at("2026-11-27 23:00", "Europe/Stockholm")),
+		"Changes are frozen from 2026-11-27 until 2026-11-30: Black Friday sales",
+	)
+
+	// The backup has its own window, but the freezes of shop still apply
+	item, _ = ResolveRef(repos, "shop ops backup")
+	backup := item.(*Command)
+	assert.Nil(backup.Guard(at("2026-10-25 03:00", "UTC")))
+	assert.Error(backup.Guard(at("2026-10-19 23:00", "Europe/Stockholm")))
+	assert.Contains(backup.Guard(at("2026-11-28 03:00", "UTC")).Error(), "frozen")
+
+	// Read-only commands can always run
+	item, _ = ResolveRef(repos, "shop ops healthcheck")
+	assert.Nil(item.(*Command).Guard(at("2026-11-28 12:00", "UTC")))
+}
+
+func TestValidateSchedule(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(validateSchedule(
+		[]Window{{Days: []string{"Mon", "weekends"}, Start: "22:00", End: "06:00"}},
+		[]Freeze{{Start: "2026-12-20", End: "2027-01-06 12:00"}},
+	))
+
+	assert.EqualError(
+		validateSchedule([]Window{{Days: []string{"friday"}, Start: "22:00", End: "06:00"}}, nil),
+		`invalid maintenance window friday 22:00-06:00: Invalid day "friday"; use mon-sun, weekdays or weekends`,
+	)
+	assert.EqualError(
+		validateSchedule([]Window{{Start: "10pm", End: "06:00"}}, nil),
+		`invalid maintenance window every day 10pm-06:00: Invalid time of day "10pm"; use 15:04`,
+	)
+	assert.Error(validateSchedule([]Window{{Start: "22:00", End: "06:00", Timezone: "Mars/Olympus"}}, nil))
+	assert.EqualError(
+		validateSchedule(nil, []Freeze{{Start: "2026-12-20", End: "after christmas"}}),
+		`invalid freeze: Invalid date "after christmas"; use 2006-01-02 or 2006-01-02 15:04`,
+	)
+}